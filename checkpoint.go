@@ -0,0 +1,73 @@
+package main
+
+import "sync"
+
+// Checkpoint tracks which journal entries have been delivered so that we only
+// ever persist a cursor once everything up to and including it has been
+// acknowledged. This gives at-least-once delivery: after a crash we may resend
+// some entries, but we never skip any.
+//
+// Every entry read from the journal is given a sequence number by Read. When an
+// entry becomes the oldest message in a buffer, Hold pins it; when that buffer
+// has been delivered, Release unpins it. The committed cursor is the cursor of
+// the entry just before the oldest pinned one, or the last entry read if nothing
+// is pinned.
+type Checkpoint struct {
+	mu         sync.Mutex
+	seq        uint64
+	lastCursor string
+	prevCursor map[uint64]string // pinned seq -> cursor of the entry read before it
+	prev       string            // cursor read before the current seq
+}
+
+// Creates a checkpoint resuming from cursor, which is what the state file held.
+func NewCheckpoint(cursor string) *Checkpoint {
+	return &Checkpoint{
+		lastCursor: cursor,
+		prevCursor: map[uint64]string{},
+	}
+}
+
+// Records that the entry at cursor has been read, returns its sequence number
+func (c *Checkpoint) Read(cursor string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.prev = c.lastCursor
+	c.lastCursor = cursor
+	return c.seq
+}
+
+// Pins the most recently read entry (seq) as the oldest unacknowledged entry of a buffer.
+func (c *Checkpoint) Hold(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq != c.seq {
+		// Only the entry just read can be held, otherwise we don't know its predecessor
+		panic("checkpoint: hold of stale sequence")
+	}
+	c.prevCursor[seq] = c.prev
+}
+
+// Unpins seq once the buffer it started has been acknowledged.
+func (c *Checkpoint) Release(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.prevCursor, seq)
+}
+
+// Returns the newest cursor that is safe to persist.
+func (c *Checkpoint) Committed() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest uint64
+	for seq := range c.prevCursor {
+		if oldest == 0 || seq < oldest {
+			oldest = seq
+		}
+	}
+	if oldest == 0 {
+		return c.lastCursor
+	}
+	return c.prevCursor[oldest]
+}
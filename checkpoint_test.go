@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	c := NewCheckpoint("c0")
+	assert.Equal(t, "c0", c.Committed())
+
+	// Nothing held, so the checkpoint follows the reader
+	c.Read("c1")
+	assert.Equal(t, "c1", c.Committed())
+
+	// c2 starts a buffer, c3 is filtered out, c4 starts another buffer
+	s2 := c.Read("c2")
+	c.Hold(s2)
+	c.Read("c3")
+	s4 := c.Read("c4")
+	c.Hold(s4)
+	assert.Equal(t, "c1", c.Committed())
+
+	// Releasing the newer buffer doesn't help, c2 is still outstanding
+	c.Release(s4)
+	assert.Equal(t, "c1", c.Committed())
+
+	c.Release(s2)
+	assert.Equal(t, "c4", c.Committed())
+}
+
+func TestCheckpointFromStart(t *testing.T) {
+	c := NewCheckpoint("")
+	s := c.Read("c1")
+	c.Hold(s)
+	assert.Equal(t, "", c.Committed())
+	c.Release(s)
+	assert.Equal(t, "c1", c.Committed())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCoolDown  = 30 * time.Second
+
+	// How long to turn requests away while a half open breaker's trial is in flight
+	breakerTrialWait = time.Second
+)
+
+type BreakerState int
+
+// Values reported by the state gauge
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "half open"
+	}
+}
+
+// CircuitBreaker stops us hammering an endpoint that is failing. After Threshold
+// consecutive failures it opens and turns requests away for CoolDown. Then it is
+// half open: it lets a single trial request through, if that succeeds it closes
+// again, otherwise it stays open for another CoolDown.
+type CircuitBreaker struct {
+	Name      string
+	Threshold int
+	CoolDown  time.Duration
+	State     metrics.Gauge
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a half open trial is in flight
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+// Returned instead of making a request while the breaker is open
+type CircuitOpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open, retry after: %s", e.Name, e.RetryAfter)
+}
+
+func NewCircuitBreaker(name string, threshold int, coolDown time.Duration, state metrics.Gauge) *CircuitBreaker {
+	b := &CircuitBreaker{
+		Name:      name,
+		Threshold: threshold,
+		CoolDown:  coolDown,
+		State:     state,
+		now:       time.Now,
+	}
+	b.State.Update(int64(BreakerClosed))
+	return b
+}
+
+// Returns nil if a request may be made, in which case its outcome must be passed to
+// Record, otherwise a *CircuitOpenError saying how long to wait.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		remaining := b.CoolDown - b.now().Sub(b.openedAt)
+		if remaining > 0 {
+			return &CircuitOpenError{Name: b.Name, RetryAfter: remaining}
+		}
+		b.setState(BreakerHalfOpen)
+		b.trial = true
+		return nil
+	case BreakerHalfOpen:
+		if b.trial {
+			return &CircuitOpenError{Name: b.Name, RetryAfter: breakerTrialWait}
+		}
+		b.trial = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Records the outcome of a request that Allow let through. Only count failures
+// that say something about the endpoint, not about what we sent it.
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if state != b.state {
+		log.Printf("Circuit breaker for %s is now %s", b.Name, state)
+	}
+	b.state = state
+	b.State.Update(int64(state))
+}
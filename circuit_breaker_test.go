@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestBreaker() (*CircuitBreaker, *time.Time) {
+	now := time.Date(2019, 7, 19, 12, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker("test", 3, 30*time.Second, metrics.NewGauge())
+	b.now = func() time.Time {
+		return now
+	}
+	return b, &now
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker()
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Allow())
+		b.Record(true)
+	}
+	assert.Equal(t, int64(BreakerClosed), b.State.Value())
+
+	// A success in between starts the count again
+	assert.NoError(t, b.Allow())
+	b.Record(false)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Allow())
+		b.Record(true)
+	}
+	assert.Equal(t, int64(BreakerClosed), b.State.Value())
+
+	assert.NoError(t, b.Allow())
+	b.Record(true)
+	assert.Equal(t, int64(BreakerOpen), b.State.Value())
+	err := b.Allow()
+	assert.Equal(t, &CircuitOpenError{Name: "test", RetryAfter: 30 * time.Second}, err)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b, now := newTestBreaker()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Allow())
+		b.Record(true)
+	}
+
+	*now = now.Add(20 * time.Second)
+	assert.Equal(t, &CircuitOpenError{Name: "test", RetryAfter: 10 * time.Second}, b.Allow())
+
+	// After the cool down one trial goes through, and only one
+	*now = now.Add(10 * time.Second)
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, int64(BreakerHalfOpen), b.State.Value())
+	assert.Equal(t, &CircuitOpenError{Name: "test", RetryAfter: breakerTrialWait}, b.Allow())
+
+	// A failed trial opens it straight back up
+	b.Record(true)
+	assert.Equal(t, int64(BreakerOpen), b.State.Value())
+	assert.Error(t, b.Allow())
+
+	*now = now.Add(30 * time.Second)
+	assert.NoError(t, b.Allow())
+	b.Record(false)
+	assert.Equal(t, int64(BreakerClosed), b.State.Value())
+	assert.NoError(t, b.Allow())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often a CollectorMap checks whether its file has changed
+const CollectorMapCheckInterval = 10 * time.Second
+
+// CollectorMap is a node-local JSON file of collector URLs by namespace and name, e.g:
+//
+//	{"ns-a": {"team-a": "https://collectors.sumologic.com/receiver/v1/http/..."}, "ns-b": {"team-b": "..."}}
+//
+// Pods pick one of their own namespace's collectors by name with an annotation, so
+// that the URLs, which are secrets, stay out of the pod specs, and a pod can't send
+// to another team's collector. The file is re-read when it changes, so tenants can
+// be added without a restart.
+type CollectorMap struct {
+	Path string
+
+	mu      sync.Mutex
+	urls    map[string]map[string]string
+	modTime time.Time
+	checked time.Time
+	missing map[string]bool // namespace/names we've already warned about
+	now     func() time.Time
+}
+
+// Loads the map, failing if the file can't be read to begin with
+func LoadCollectorMap(path string) (*CollectorMap, error) {
+	c := &CollectorMap{Path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	err = readJSONFile(path, &c.urls)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	c.modTime = info.ModTime()
+	c.checked = time.Now()
+	return c, nil
+}
+
+// Returns the URL of the namespace's collector called name, or empty if there isn't one
+func (c *CollectorMap) URL(namespace string, name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reloadIfChanged()
+	url := c.urls[namespace][name]
+	if url == "" && !c.missing[namespace+"/"+name] {
+		log.Printf("No collector named %q for namespace %q in %s, sending to the default collectors instead", name, namespace, c.Path)
+		if c.missing == nil {
+			c.missing = map[string]bool{}
+		}
+		c.missing[namespace+"/"+name] = true
+	}
+	return url
+}
+
+// Keeps the last good version of the file if it can't be read. The caller holds c.mu.
+func (c *CollectorMap) reloadIfChanged() {
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+	if now.Sub(c.checked) < CollectorMapCheckInterval {
+		return
+	}
+	c.checked = now
+
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		log.Println("Error reading collector map: ", err)
+		return
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return
+	}
+	var urls map[string]map[string]string
+	err = readJSONFile(c.Path, &urls)
+	if err != nil {
+		log.Println("Error reading collector map: ", c.Path, err)
+		return
+	}
+	c.urls = urls
+	c.modTime = info.ModTime()
+	c.missing = nil
+}
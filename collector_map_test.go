@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCollectorMap(t *testing.T, path string, contents string, modTime time.Time) {
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), os.FileMode(0600)))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// Loads a collector map from a temporary file, which the caller removes
+func newTestCollectorMap(t *testing.T, contents string) *CollectorMap {
+	f, err := ioutil.TempFile("", "collector-map")
+	assert.NoError(t, err)
+	_, err = f.WriteString(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	c, err := LoadCollectorMap(f.Name())
+	assert.NoError(t, err)
+	return c
+}
+
+func TestCollectorMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector-map")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "collectors.json")
+	start := time.Now()
+	writeTestCollectorMap(t, path, `{"ns-a": {"team-a": "http://a"}}`, start)
+
+	c, err := LoadCollectorMap(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://a", c.URL("ns-a", "team-a"))
+	assert.Equal(t, "", c.URL("ns-a", "team-b"))
+
+	// Changes are only noticed on the next check
+	now := c.checked
+	c.now = func() time.Time { return now }
+	writeTestCollectorMap(t, path, `{"ns-a": {"team-a": "http://a2"}, "ns-b": {"team-b": "http://b"}}`, start.Add(time.Second))
+	assert.Equal(t, "", c.URL("ns-b", "team-b"))
+	now = now.Add(CollectorMapCheckInterval)
+	assert.Equal(t, "http://a2", c.URL("ns-a", "team-a"))
+	assert.Equal(t, "http://b", c.URL("ns-b", "team-b"))
+
+	// A broken file doesn't lose the last good one
+	writeTestCollectorMap(t, path, `{"ns-a": `, start.Add(2*time.Second))
+	now = now.Add(CollectorMapCheckInterval)
+	assert.Equal(t, "http://b", c.URL("ns-b", "team-b"))
+}
+
+func TestLoadCollectorMapErrors(t *testing.T) {
+	_, err := LoadCollectorMap("/nonexistent/collectors.json")
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "collector-map")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"team-a": "http://a"}`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	_, err = LoadCollectorMap(f.Name())
+	assert.Error(t, err)
+}
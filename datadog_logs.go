@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultDatadogLogsURL = "https://http-intake.logs.datadoghq.com"
+
+	// The intake's limits on each request, uncompressed
+	DatadogMaxEntries = 1000
+	DatadogMaxBytes   = 5 * 1024 * 1024
+
+	// The intake truncates logs bigger than this, we do it first so they always fit
+	// in a request, and say so
+	DatadogMaxEntryBytes = 1024 * 1024
+	datadogTruncated     = "...[truncated]"
+)
+
+// Pod labels that name the service, in order of preference
+var datadogServiceLabels = []string{
+	"tags.datadoghq.com/service",
+	"app.kubernetes.io/name",
+	"app",
+	"k8s-app",
+}
+
+var datadogCamelCase = regexp.MustCompile("([a-z0-9])([A-Z])")
+
+// DatadogLogsOutput sends entries to the Datadog HTTP logs intake.
+// See: https://docs.datadoghq.com/api/latest/logs/#send-logs
+//
+// Batches are split to keep within the intake's limits on entries and bytes per
+// request, and entries are truncated to its limit on each log. ddsource is the container, or the source outside of containers, service
+// comes from the pod's labels, falling back on its owner or the source, and ddtags
+// describe where in kubernetes the entry came from, the way the Datadog agent does.
+type DatadogLogsOutput struct {
+	httpClient *http.Client
+	URL        string // intake for the Datadog site, e.g https://http-intake.logs.datadoghq.eu
+	APIKey     string
+	Tags       []string // added to every entry's tags, e.g env:prod
+
+	// Limits for each request, and entry, default to the intake's
+	MaxEntries    int
+	MaxBytes      int
+	MaxEntryBytes int
+}
+
+type datadogLog struct {
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"` // milliseconds since the epoch
+	Hostname  string `json:"hostname,omitempty"`
+	Source    string `json:"ddsource,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Tags      string `json:"ddtags,omitempty"`
+}
+
+func (dd *DatadogLogsOutput) Name() string {
+	return "datadog"
+}
+
+func (dd *DatadogLogsOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	maxEntries := dd.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DatadogMaxEntries
+	}
+	maxBytes := dd.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DatadogMaxBytes
+	}
+	maxEntryBytes := dd.MaxEntryBytes
+	if maxEntryBytes <= 0 {
+		maxEntryBytes = DatadogMaxEntryBytes
+	}
+	if maxEntryBytes > maxBytes-2 {
+		// It has to fit in a request too
+		maxEntryBytes = maxBytes - 2
+	}
+
+	source, service, tags := datadogSource(metadata), datadogService(metadata), dd.tags(metadata)
+	partial := &PartialError{}
+	var firstError error
+
+	// Split into requests, each a JSON array of up to maxEntries, of up to maxBytes
+	type request struct {
+		body    bytes.Buffer
+		entries []LogEntry
+	}
+	var requests []*request
+	current := &request{}
+	for _, entry := range batch {
+		encoded, err := datadogEncode(datadogLog{
+			Message:   entry.Message,
+			Timestamp: int64(entry.Timestamp / 1000),
+			Hostname:  metadata.host,
+			Source:    source,
+			Service:   service,
+			Tags:      tags,
+		}, maxEntryBytes)
+		if err != nil {
+			return err
+		}
+		if len(encoded) > maxEntryBytes {
+			partial.Rejected = append(partial.Rejected, entry)
+			if firstError == nil {
+				firstError = fmt.Errorf("entry of %d bytes is over the limit of %d", len(encoded), maxEntryBytes)
+			}
+			continue
+		}
+		if len(current.entries) == maxEntries || current.body.Len()+len(encoded)+2 > maxBytes {
+			requests = append(requests, current)
+			current = &request{}
+		}
+		if len(current.entries) == 0 {
+			current.body.WriteByte('[')
+		} else {
+			current.body.WriteByte(',')
+		}
+		current.body.Write(encoded)
+		current.entries = append(current.entries, entry)
+	}
+	if len(current.entries) > 0 {
+		requests = append(requests, current)
+	}
+
+	sent := 0
+	var retryError error
+	for i, req := range requests {
+		req.body.WriteByte(']')
+		err := dd.post(ctx, req.body.Bytes())
+		if err == nil {
+			sent += len(req.entries)
+			continue
+		}
+		if firstError == nil {
+			firstError = err
+		}
+		if _, ok := err.(*RejectedError); ok {
+			partial.Rejected = append(partial.Rejected, req.entries...)
+			continue
+		}
+		if sent == 0 && len(partial.Rejected) == 0 {
+			// Nothing's gone yet, so it's as if it was one request
+			return err
+		}
+		retryError = err
+		for _, rest := range requests[i:] {
+			partial.Retry = append(partial.Retry, rest.entries...)
+		}
+		break
+	}
+
+	if len(partial.Retry) == 0 && len(partial.Rejected) == 0 {
+		return nil
+	}
+	if len(partial.Retry) > 0 {
+		// Keep the class of what failed, e.g. throttling, so the retry is handled for it
+		partial.Err = retryError
+		return partial
+	}
+	partial.Err = fmt.Errorf("datadog accepted %d of %d entries, first error: %s", sent, len(batch), firstError)
+	return partial
+}
+
+// Encodes a log, cutting its message short, and marking where, if it would be over limit
+func datadogEncode(l datadogLog, limit int) ([]byte, error) {
+	encoded, err := json.Marshal(l)
+	message := l.Message
+	for err == nil && len(encoded) > limit {
+		// Escaping can make the message longer encoded, so it may take a few goes
+		keep := len(l.Message) - (len(encoded) - limit) - len(datadogTruncated)
+		if keep < 0 {
+			// Mostly escapes, so guess from how much it grew
+			keep = len(l.Message)*limit/len(encoded) - len(datadogTruncated)
+		}
+		if keep >= len(message) {
+			keep = len(message) - 1
+		}
+		if keep < 0 {
+			// Too big even with none of the message
+			break
+		}
+		for keep > 0 && !utf8.RuneStart(message[keep]) {
+			keep--
+		}
+		message = message[:keep]
+		l.Message = message + datadogTruncated
+		encoded, err = json.Marshal(l)
+	}
+	return encoded, err
+}
+
+func (dd *DatadogLogsOutput) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(dd.URL, "/")+"/api/v2/logs", bytes.NewReader(compress(string(body))))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("DD-API-KEY", dd.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := dd.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading datadog response: %s", err)
+	}
+	return HTTPResponseError(resp, respBody)
+}
+
+func datadogSource(metadata MetadataValues) string {
+	if metadata.container != "" {
+		return metadata.container
+	}
+	return metadata.source
+}
+
+func datadogService(metadata MetadataValues) string {
+	for _, label := range datadogServiceLabels {
+		if metadata.labels[label] != "" {
+			return metadata.labels[label]
+		}
+	}
+	if metadata.owner != "" {
+		return metadata.owner
+	}
+	return metadata.source
+}
+
+// Tags named like the Datadog agent's, e.g kube_namespace, kube_daemon_set
+func (dd *DatadogLogsOutput) tags(metadata MetadataValues) string {
+	tags := append([]string{}, dd.Tags...)
+	add := func(name string, value string) {
+		if value != "" {
+			tags = append(tags, name+":"+value)
+		}
+	}
+	add("source_category", metadata.category)
+	add("kube_namespace", metadata.namespace)
+	add("pod_name", metadata.pod)
+	add("kube_container_name", metadata.container)
+	if metadata.ownerKind != "" {
+		// e.g. ReplicaSet is kube_replica_set
+		add("kube_"+strings.ToLower(datadogCamelCase.ReplaceAllString(metadata.ownerKind, "${1}_${2}")), metadata.owner)
+	}
+	add("env", metadata.labels["tags.datadoghq.com/env"])
+	add("version", metadata.labels["tags.datadoghq.com/version"])
+	return strings.Join(tags, ",")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// testDatadogIntake records the logs it gets in each request, responding with the
+// next of statuses, or 202 once it runs out
+type testDatadogIntake struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests [][]datadogLog
+	apiKeys  []string
+}
+
+func newTestDatadogIntake(statuses ...int) *testDatadogIntake {
+	intake := &testDatadogIntake{statuses: statuses}
+	intake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		intake.mu.Lock()
+		defer intake.mu.Unlock()
+		gz, err := gzip.NewReader(r.Body)
+		var logs []datadogLog
+		if r.URL.Path != "/api/v2/logs" || err != nil || json.NewDecoder(gz).Decode(&logs) != nil {
+			w.WriteHeader(400)
+			return
+		}
+		intake.requests = append(intake.requests, logs)
+		intake.apiKeys = append(intake.apiKeys, r.Header.Get("DD-API-KEY"))
+		status := 202
+		if len(intake.statuses) > 0 {
+			status, intake.statuses = intake.statuses[0], intake.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return intake
+}
+
+func (intake *testDatadogIntake) Messages() [][]string {
+	intake.mu.Lock()
+	defer intake.mu.Unlock()
+	var messages [][]string
+	for _, logs := range intake.requests {
+		var request []string
+		for _, l := range logs {
+			request = append(request, l.Message)
+		}
+		messages = append(messages, request)
+	}
+	return messages
+}
+
+func TestDatadogLogs(t *testing.T) {
+	intake := newTestDatadogIntake()
+	defer intake.Close()
+	dd := &DatadogLogsOutput{httpClient: &http.Client{}, URL: intake.URL, APIKey: "key", Tags: []string{"team:platform"}}
+
+	metadata := MetadataValues{
+		category:  "prod/kubernetes/kube-system/kube-proxy",
+		source:    "kube-system.kube-proxy-abcde",
+		host:      "node-1",
+		namespace: "kube-system",
+		pod:       "kube-proxy-abcde",
+		owner:     "kube-proxy",
+		ownerKind: "DaemonSet",
+		container: "kube-proxy",
+		labels:    map[string]string{"k8s-app": "kube-proxy-app", "tags.datadoghq.com/env": "prod"},
+	}
+	batch := testEntries("one")
+	batch[0].Timestamp = 1563537600123456
+	assert.NoError(t, dd.Send(context.Background(), metadata, batch))
+
+	assert.Equal(t, []string{"key"}, intake.apiKeys)
+	assert.Equal(t, [][]datadogLog{{{
+		Message:   "one",
+		Timestamp: 1563537600123,
+		Hostname:  "node-1",
+		Source:    "kube-proxy",
+		Service:   "kube-proxy-app",
+		Tags:      "team:platform,source_category:prod/kubernetes/kube-system/kube-proxy,kube_namespace:kube-system,pod_name:kube-proxy-abcde,kube_container_name:kube-proxy,kube_daemon_set:kube-proxy,env:prod",
+	}}}, intake.requests)
+}
+
+func TestDatadogServiceAndSource(t *testing.T) {
+	systemd := MetadataValues{category: "prod/systemd/kubelet", source: "kubelet"}
+	assert.Equal(t, "kubelet", datadogService(systemd))
+	assert.Equal(t, "kubelet", datadogSource(systemd))
+
+	pod := MetadataValues{source: "ns.web-123", owner: "web-5d9c", container: "nginx"}
+	assert.Equal(t, "web-5d9c", datadogService(pod))
+	assert.Equal(t, "nginx", datadogSource(pod))
+	pod.labels = map[string]string{"app": "web", "app.kubernetes.io/name": "website"}
+	assert.Equal(t, "website", datadogService(pod))
+}
+
+func TestDatadogLogsSplitsBatches(t *testing.T) {
+	intake := newTestDatadogIntake()
+	defer intake.Close()
+	dd := &DatadogLogsOutput{httpClient: &http.Client{}, URL: intake.URL, MaxEntries: 2}
+
+	// By count
+	assert.NoError(t, dd.Send(context.Background(), MetadataValues{}, testEntries("1", "2", "3", "4", "5")))
+	assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}, {"5"}}, intake.Messages())
+
+	// By size, each log here is 34 bytes encoded
+	intake.requests = nil
+	dd.MaxEntries = 0
+	dd.MaxBytes = 80
+	assert.NoError(t, dd.Send(context.Background(), MetadataValues{}, testEntries("1", "2", "3")))
+	assert.Equal(t, [][]string{{"1", "2"}, {"3"}}, intake.Messages())
+}
+
+func TestDatadogLogsPartialFailure(t *testing.T) {
+	intake := newTestDatadogIntake(202, 400, 429)
+	defer intake.Close()
+	dd := &DatadogLogsOutput{httpClient: &http.Client{}, URL: intake.URL, MaxEntries: 1}
+
+	batch := testEntries("1", "2", "3", "4")
+	err := dd.Send(context.Background(), MetadataValues{}, batch)
+	if assert.IsType(t, &PartialError{}, err) {
+		e := err.(*PartialError)
+		assert.Equal(t, batch[1:2], e.Rejected)
+		assert.Equal(t, batch[2:], e.Retry)
+		// Still throttling, so the worker waits as it should
+		assert.IsType(t, &ThrottledError{}, e.Err)
+	}
+
+	// Nothing got through, so it's the error as is
+	intake.statuses = []int{429}
+	err = dd.Send(context.Background(), MetadataValues{}, testEntries("1"))
+	assert.IsType(t, &ThrottledError{}, err)
+}
+
+func TestDatadogLogsPartialUnauthorized(t *testing.T) {
+	intake := newTestDatadogIntake(202, 403)
+	defer intake.Close()
+	dd := &DatadogLogsOutput{httpClient: &http.Client{}, URL: intake.URL, MaxEntries: 1}
+	worker := NewOutputWorker(dd, &Metrics{})
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		assert.Equal(t, []string{"output datadog: credentials rejected, status code: 403"}, health.Problems())
+		return true
+	}
+
+	assert.True(t, worker.Deliver(MetadataValues{}, testEntries("1", "2"), nil))
+	assert.Equal(t, [][]string{{"1"}, {"2"}, {"2"}}, intake.Messages())
+	assert.Equal(t, int64(1), worker.Metrics.UploadUnauthorized.Count())
+	assert.Empty(t, health.Problems())
+}
+
+func TestDatadogLogsTruncatesBigEntries(t *testing.T) {
+	intake := newTestDatadogIntake()
+	defer intake.Close()
+	dd := &DatadogLogsOutput{httpClient: &http.Client{}, URL: intake.URL}
+
+	// A log that encodes to exactly the limit, one a byte over, and one well over
+	// with characters that take more than one byte, and escaping
+	empty, _ := json.Marshal(datadogLog{})
+	limit := strings.Repeat("x", DatadogMaxEntryBytes-len(empty))
+	wide := strings.Repeat("\u00e9<", DatadogMaxEntryBytes)
+	assert.NoError(t, dd.Send(context.Background(), MetadataValues{}, testEntries(limit, limit+"x", wide)))
+
+	messages := intake.Messages()
+	if assert.Len(t, messages, 1) && assert.Len(t, messages[0], 3) {
+		assert.Equal(t, limit, messages[0][0])
+		assert.Equal(t, limit[:len(limit)-len(datadogTruncated)]+datadogTruncated, messages[0][1])
+		kept := strings.TrimSuffix(messages[0][2], datadogTruncated)
+		assert.True(t, len(kept) < len(messages[0][2]) && len(kept) > DatadogMaxEntryBytes/4, "%d bytes kept", len(kept))
+		assert.True(t, utf8.ValidString(kept) && strings.HasPrefix(wide, kept))
+		for _, message := range messages[0] {
+			encoded, _ := json.Marshal(datadogLog{Message: message})
+			assert.True(t, len(encoded) <= DatadogMaxEntryBytes, "%d bytes", len(encoded))
+		}
+	}
+}
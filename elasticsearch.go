@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultElasticsearchIndex      = "logs-{category}-{date}"
+	DefaultElasticsearchDateFormat = "2006.01.02"
+)
+
+// Characters elasticsearch doesn't allow in index names, replaced with -
+var elasticsearchIndexReplacer = strings.NewReplacer(
+	"/", "-", "\\", "-", "*", "-", "?", "-", "\"", "-", "<", "-", ">", "-",
+	"|", "-", " ", "-", ",", "-", "#", "-", ":", "-",
+)
+
+// ElasticsearchOutput writes entries to Elasticsearch, or OpenSearch, with the _bulk API.
+// See: https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+//
+// Each entry is a document with the id derived from its journal cursor, so an entry
+// that is sent again after a retry or a restart overwrites itself rather than
+// being duplicated.
+type ElasticsearchOutput struct {
+	httpClient *http.Client
+	URL        string // e.g http://localhost:9200
+	Username   string
+	Password   string
+
+	// Index name, {category}, {source}, {host} and {namespace} are replaced with the
+	// entry's metadata and {date} with its timestamp in DateFormat (a go time layout)
+	Index      string
+	DateFormat string
+}
+
+func (es *ElasticsearchOutput) Name() string {
+	return "elasticsearch"
+}
+
+type elasticsearchDocument struct {
+	Timestamp string            `json:"@timestamp"`
+	Message   string            `json:"message"`
+	Category  string            `json:"category"`
+	Source    string            `json:"source"`
+	Host      string            `json:"host"`
+	Namespace string            `json:"namespace,omitempty"`
+	Fields    map[string]string `json:"journal"`
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	// One per action, in the order they were sent, keyed by the action
+	Items []map[string]elasticsearchBulkItem `json:"items"`
+}
+
+type elasticsearchBulkItem struct {
+	Status int                 `json:"status"`
+	Error  *elasticsearchError `json:"error,omitempty"`
+}
+
+type elasticsearchError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (es *ElasticsearchOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, entry := range batch {
+		action := map[string]map[string]string{
+			"index": {"_index": es.indexFor(metadata, entry), "_id": elasticsearchID(entry)},
+		}
+		err := enc.Encode(action)
+		if err == nil {
+			err = enc.Encode(elasticsearchDocument{
+				Timestamp: entryTime(entry).Format(time.RFC3339Nano),
+				Message:   entry.Message,
+				Category:  metadata.category,
+				Source:    metadata.source,
+				Host:      metadata.host,
+				Namespace: metadata.namespace,
+				Fields:    entry.Fields,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(es.URL, "/")+"/_bulk", &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if es.Username != "" {
+		req.SetBasicAuth(es.Username, es.Password)
+	}
+
+	resp, err := es.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading elasticsearch response: %s", err)
+	}
+	err = HTTPResponseError(resp, respBody)
+	if err != nil {
+		return err
+	}
+
+	var bulk elasticsearchBulkResponse
+	err = json.Unmarshal(respBody, &bulk)
+	if err != nil {
+		return fmt.Errorf("error decoding elasticsearch bulk response: %s", err)
+	}
+	if !bulk.Errors {
+		return nil
+	}
+	if len(bulk.Items) != len(batch) {
+		return fmt.Errorf("elasticsearch bulk response has %d items for %d documents", len(bulk.Items), len(batch))
+	}
+
+	// Some documents failed, work out which are worth sending again
+	partial := &PartialError{}
+	var firstError string
+	for i, item := range bulk.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status < 300 {
+				continue
+			}
+			if firstError == "" && result.Error != nil {
+				firstError = fmt.Sprintf("status %d: %s: %s", result.Status, result.Error.Type, result.Error.Reason)
+			}
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				partial.Retry = append(partial.Retry, batch[i])
+			} else {
+				// e.g a mapping error, it'll never be accepted
+				partial.Rejected = append(partial.Rejected, batch[i])
+			}
+		}
+	}
+	partial.Err = fmt.Errorf("elasticsearch rejected %d of %d documents, first error: %s",
+		len(partial.Retry)+len(partial.Rejected), len(batch), firstError)
+	return partial
+}
+
+func (es *ElasticsearchOutput) indexFor(metadata MetadataValues, entry LogEntry) string {
+	index := strings.NewReplacer(
+		"{category}", metadata.category,
+		"{source}", metadata.source,
+		"{host}", metadata.host,
+		"{namespace}", metadata.namespace,
+		"{date}", entryTime(entry).Format(es.DateFormat),
+	).Replace(es.Index)
+	// Index names must be lower case, and can't start with - or _
+	index = strings.ToLower(elasticsearchIndexReplacer.Replace(index))
+	return strings.TrimLeft(index, "-_")
+}
+
+func elasticsearchID(entry LogEntry) string {
+	sum := sha1.Sum([]byte(entry.Cursor))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns when the entry was logged, from the journal's realtime timestamp
+func entryTime(entry LogEntry) time.Time {
+	return time.Unix(0, int64(entry.Timestamp)*int64(time.Microsecond)).UTC()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testElasticsearch accepts bulk requests, failing documents whose message is in failures
+// with the given status, once each
+type testElasticsearch struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures map[string]int
+	actions  []map[string]map[string]string
+	docs     []elasticsearchDocument
+	requests int
+}
+
+func newTestElasticsearch(failures map[string]int) *testElasticsearch {
+	es := &testElasticsearch{failures: failures}
+	es.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		es.requests++
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(404)
+			return
+		}
+
+		var resp elasticsearchBulkResponse
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			var doc elasticsearchDocument
+			_ = json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			_ = json.Unmarshal(scanner.Bytes(), &doc)
+
+			result := elasticsearchBulkItem{Status: 201}
+			if status := es.failures[doc.Message]; status != 0 {
+				delete(es.failures, doc.Message)
+				resp.Errors = true
+				result = elasticsearchBulkItem{
+					Status: status,
+					Error:  &elasticsearchError{"test_exception", "failed " + doc.Message},
+				}
+			} else {
+				es.actions = append(es.actions, action)
+				es.docs = append(es.docs, doc)
+			}
+			resp.Items = append(resp.Items, map[string]elasticsearchBulkItem{"index": result})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	return es
+}
+
+func (es *testElasticsearch) Messages() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	var messages []string
+	for _, doc := range es.docs {
+		messages = append(messages, doc.Message)
+	}
+	return messages
+}
+
+func newTestElasticsearchOutput(url string) *ElasticsearchOutput {
+	return &ElasticsearchOutput{
+		httpClient: &http.Client{},
+		URL:        url,
+		Index:      DefaultElasticsearchIndex,
+		DateFormat: DefaultElasticsearchDateFormat,
+	}
+}
+
+func TestElasticsearchDocuments(t *testing.T) {
+	server := newTestElasticsearch(nil)
+	defer server.Close()
+	es := newTestElasticsearchOutput(server.URL)
+
+	metadata := MetadataValues{
+		category:  "k8s/Prod/kube-system/kube-proxy",
+		source:    "kube-proxy",
+		host:      "node-1",
+		namespace: "kube-system",
+	}
+	entries := []LogEntry{{
+		Cursor:    "s=test;i=1",
+		Timestamp: 1563537600123456,
+		Message:   "hello",
+		Fields:    map[string]string{"_TRANSPORT": "journal", "PRIORITY": "6"},
+	}}
+	assert.NoError(t, es.Send(context.Background(), metadata, entries))
+
+	assert.Equal(t, []map[string]map[string]string{{
+		"index": {
+			"_index": "logs-k8s-prod-kube-system-kube-proxy-2019.07.19",
+			"_id":    "a3fc0e501da08c403172bf445720c660ee2c7baf",
+		},
+	}}, server.actions)
+	assert.Equal(t, []elasticsearchDocument{{
+		Timestamp: "2019-07-19T12:00:00.123456Z",
+		Message:   "hello",
+		Category:  "k8s/Prod/kube-system/kube-proxy",
+		Source:    "kube-proxy",
+		Host:      "node-1",
+		Namespace: "kube-system",
+		Fields:    map[string]string{"_TRANSPORT": "journal", "PRIORITY": "6"},
+	}}, server.docs)
+}
+
+func TestElasticsearchIndex(t *testing.T) {
+	es := &ElasticsearchOutput{Index: "{host}_{source}-{date}", DateFormat: "2006.01"}
+	entry := LogEntry{Timestamp: 1563537600123456}
+	assert.Equal(t, "node-1_kube-proxy-2019.07", es.indexFor(MetadataValues{host: "Node-1", source: "kube-proxy"}, entry))
+	assert.Equal(t, "kube-proxy-2019.07", es.indexFor(MetadataValues{source: "kube-proxy"}, entry))
+}
+
+func TestElasticsearchRetriesOnlyFailedDocuments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder-deadletter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := newTestElasticsearch(map[string]int{"two": 429, "three": 400, "four": 503})
+	defer server.Close()
+	metrics := &Metrics{}
+	metrics.Init()
+	worker := NewOutputWorker(newTestElasticsearchOutput(server.URL), metrics)
+	worker.DeadLetterDir = dir
+	var sleeps []time.Duration
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		sleeps = append(sleeps, d)
+		return true
+	}
+
+	assert.True(t, worker.Deliver(MetadataValues{}, testEntries("one", "two", "three", "four", "five"), nil))
+	assert.Equal(t, 2, server.requests)
+	assert.Len(t, sleeps, 1)
+
+	// "two" and "four" were sent again on their own, "three" never will be
+	assert.Equal(t, []string{"one", "five", "two", "four"}, server.Messages())
+	assert.Equal(t, int64(4), worker.Metrics.UploadMessages.Count())
+	assert.Equal(t, int64(1), worker.Metrics.DeadLetterMessages.Count())
+	files, err := filepath.Glob(filepath.Join(dir, "elasticsearch", "*.json.gz"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DefaultFailoverAfter         = 2 * time.Minute
+	DefaultFailoverProbeInterval = time.Minute
+)
+
+// Failover moves uploads from a primary endpoint to a secondary once the primary
+// has been failing for After, with no success in between. While failed over, the
+// first request after every ProbeInterval goes to the primary to see if it has
+// recovered, and as soon as one succeeds we fail back.
+//
+// Server errors, timeouts and being unreachable count as failing, but not being
+// throttled with a 429, as that means we're over quota rather than the endpoint
+// being down.
+type Failover struct {
+	Name          string
+	Secondary     string // url
+	After         time.Duration
+	ProbeInterval time.Duration
+	Active        metrics.Gauge // 0 while using the primary, 1 the secondary
+	Duration      metrics.Timer // how long each failover lasted
+
+	mu           sync.Mutex
+	failingSince time.Time // zero unless the primary's last request failed
+	failedOver   bool
+	failedOverAt time.Time
+	lastProbe    time.Time
+	probing      bool // a probe of the primary is in flight
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+func NewFailover(name string, secondary string, after time.Duration, probeInterval time.Duration, active metrics.Gauge, duration metrics.Timer) *Failover {
+	f := &Failover{
+		Name:          name,
+		Secondary:     secondary,
+		After:         after,
+		ProbeInterval: probeInterval,
+		Active:        active,
+		Duration:      duration,
+		now:           time.Now,
+	}
+	f.Active.Update(0)
+	return f
+}
+
+// Returns true if the next request should go to the primary, in which case its
+// outcome must be passed to Record, otherwise it should go to the secondary.
+func (f *Failover) UsePrimary() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	if !f.failedOver {
+		if f.failingSince.IsZero() || now.Sub(f.failingSince) < f.After {
+			return true
+		}
+		log.Printf("Failing over from %s to %s, it has been failing for %s", f.Name, f.Secondary, now.Sub(f.failingSince))
+		f.failedOver = true
+		f.failedOverAt = now
+		f.lastProbe = now
+		f.Active.Update(1)
+		return false
+	}
+	if f.probing || now.Sub(f.lastProbe) < f.ProbeInterval {
+		return false
+	}
+	f.probing = true
+	f.lastProbe = now
+	return true
+}
+
+// Records the outcome of a request that UsePrimary sent to the primary
+func (f *Failover) Record(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.probing = false
+	if _, ok := err.(*CircuitOpenError); ok {
+		// It didn't get as far as the primary
+		return
+	}
+	now := f.now()
+	if failoverError(err) {
+		if f.failingSince.IsZero() {
+			f.failingSince = now
+		}
+		return
+	}
+	f.failingSince = time.Time{}
+	if f.failedOver {
+		lasted := now.Sub(f.failedOverAt)
+		log.Printf("%s has recovered, failing back to it after %s", f.Name, lasted)
+		f.failedOver = false
+		f.Active.Update(0)
+		f.Duration.Update(lasted)
+	}
+}
+
+// Returns true if err says the endpoint is down
+func failoverError(err error) bool {
+	if e, ok := err.(*ThrottledError); ok {
+		return e.StatusCode != http.StatusTooManyRequests
+	}
+	return EndpointFailed(err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestFailover() (*Failover, *time.Time) {
+	now := time.Date(2019, 7, 19, 12, 0, 0, 0, time.UTC)
+	f := NewFailover("test", "http://secondary", time.Minute, 10*time.Second, metrics.NewGauge(), metrics.NewTimer())
+	f.now = func() time.Time {
+		return now
+	}
+	return f, &now
+}
+
+var errServer = errors.New("failed upload, status code: 500")
+
+func TestFailoverAfterThreshold(t *testing.T) {
+	f, now := newTestFailover()
+	assert.True(t, f.UsePrimary())
+	f.Record(errServer)
+
+	// Failing, but not for long enough
+	*now = now.Add(30 * time.Second)
+	assert.True(t, f.UsePrimary())
+	f.Record(errServer)
+
+	// A success in between starts the clock again
+	assert.True(t, f.UsePrimary())
+	f.Record(nil)
+	assert.True(t, f.UsePrimary())
+	f.Record(errServer)
+	*now = now.Add(59 * time.Second)
+	assert.True(t, f.UsePrimary())
+	f.Record(&CircuitOpenError{Name: "test", RetryAfter: time.Second})
+	assert.Equal(t, int64(0), f.Active.Value())
+
+	*now = now.Add(time.Second)
+	assert.False(t, f.UsePrimary())
+	assert.Equal(t, int64(1), f.Active.Value())
+}
+
+func TestFailoverIgnoresQuotaThrottling(t *testing.T) {
+	f, now := newTestFailover()
+	assert.True(t, f.UsePrimary())
+	f.Record(&ThrottledError{StatusCode: 429})
+	*now = now.Add(time.Hour)
+	assert.True(t, f.UsePrimary())
+
+	// but a 503 says it's down
+	f.Record(&ThrottledError{StatusCode: 503})
+	*now = now.Add(time.Minute)
+	assert.False(t, f.UsePrimary())
+}
+
+func TestFailoverProbesAndFailsBack(t *testing.T) {
+	f, now := newTestFailover()
+	assert.True(t, f.UsePrimary())
+	f.Record(errServer)
+	*now = now.Add(time.Minute)
+	assert.False(t, f.UsePrimary())
+
+	// A failed probe, every ProbeInterval, one at a time
+	*now = now.Add(5 * time.Second)
+	assert.False(t, f.UsePrimary())
+	*now = now.Add(5 * time.Second)
+	assert.True(t, f.UsePrimary())
+	assert.False(t, f.UsePrimary())
+	f.Record(errServer)
+	assert.False(t, f.UsePrimary())
+	assert.Equal(t, int64(1), f.Active.Value())
+
+	// and a successful one
+	*now = now.Add(10 * time.Second)
+	assert.True(t, f.UsePrimary())
+	f.Record(nil)
+	assert.True(t, f.UsePrimary())
+	assert.Equal(t, int64(0), f.Active.Value())
+	assert.Equal(t, int64(1), f.Duration.Count())
+	assert.Equal(t, int64(20*time.Second), f.Duration.Max())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultFileOutputPath = "archive.log"
+
+// FileOutput appends the lines we would have sent to sumo to a local file, which
+// gives us an on-node archive of everything forwarded.
+//
+// If PerCategory is set each category gets its own file, with the same name as Path
+// in a directory per category next to it, e.g. archive/prod/systemd/kubelet/archive.log
+// for a Path of archive/archive.log.
+//
+// A file is rotated once it reaches MaxBytes or is older than MaxAge, by renaming it
+// with the time, e.g. archive-20190719T120000.000000000Z.log, so old files sort oldest
+// first. Then the oldest old files are removed, beyond MaxOldFiles of each file and
+// beyond MaxTotalBytes next to and below Path.
+//
+// If Compress is set each batch is appended as a gzip member, so files are always
+// valid gzip and can be read with zcat while they are being written.
+type FileOutput struct {
+	Path          string
+	PerCategory   bool
+	Compress      bool
+	MaxBytes      int64         // rotate at this size, 0 for no limit
+	MaxAge        time.Duration // rotate at this age, 0 for no limit
+	MaxOldFiles   int           // old files to keep of each file, 0 for no limit
+	MaxTotalBytes int64         // old files' bytes to keep, 0 for no limit
+
+	mu    sync.Mutex
+	files map[string]*openedFile // path -> what we know of it
+	now   func() time.Time
+}
+
+type openedFile struct {
+	size    int64
+	started time.Time
+}
+
+// A rotated file
+type oldFile struct {
+	path string
+	size int64
+}
+
+func (fo *FileOutput) Name() string {
+	return "file"
+}
+
+func (fo *FileOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	var lines bytes.Buffer
+	for _, entry := range batch {
+		lines.WriteString(entry.Message + "\n")
+	}
+	data := lines.Bytes()
+	if fo.Compress {
+		data = compress(lines.String())
+	}
+
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	path := fo.Path
+	if fo.PerCategory {
+		path = filepath.Join(filepath.Dir(fo.Path), categoryPath(metadata.category), filepath.Base(fo.Path))
+	}
+	file, err := fo.rotateIfDue(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(data)
+	file.size += int64(n)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Returns what we know of the file at path, rotating it first if it's due
+func (fo *FileOutput) rotateIfDue(path string) (*openedFile, error) {
+	if fo.files == nil {
+		fo.files = map[string]*openedFile{}
+	}
+	if fo.now == nil {
+		fo.now = time.Now
+	}
+	now := fo.now()
+
+	file := fo.files[path]
+	if file == nil {
+		err := os.MkdirAll(filepath.Dir(path), os.FileMode(0700))
+		if err != nil {
+			return nil, err
+		}
+		// Left from before a restart, when it was started is lost but it's no later
+		// than when it was last written to
+		file = &openedFile{started: now}
+		if info, err := os.Stat(path); err == nil {
+			file = &openedFile{size: info.Size(), started: info.ModTime()}
+		}
+		fo.files[path] = file
+	}
+	if file.size == 0 || ((fo.MaxBytes <= 0 || file.size < fo.MaxBytes) && (fo.MaxAge <= 0 || now.Sub(file.started) < fo.MaxAge)) {
+		return file, nil
+	}
+
+	err := os.Rename(path, fo.oldFileName(path, now))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file = &openedFile{started: now}
+	fo.files[path] = file
+	fo.enforceRetention(filepath.Dir(path))
+	return file, nil
+}
+
+// Splits a file name at its first dot, e.g. archive and .log.gz
+func splitExt(name string) (string, string) {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i:]
+}
+
+// Names a rotated file after the time it was rotated
+func (fo *FileOutput) oldFileName(path string, t time.Time) string {
+	stem, ext := splitExt(filepath.Base(path))
+	return filepath.Join(filepath.Dir(path), stem+"-"+t.UTC().Format("20060102T150405.000000000Z")+ext)
+}
+
+// Removes the oldest old files beyond MaxOldFiles in dir, then beyond MaxTotalBytes
+// next to and below Path
+func (fo *FileOutput) enforceRetention(dir string) {
+	remove := func(path string) {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing rotated file: ", err)
+		}
+	}
+
+	if fo.MaxOldFiles > 0 {
+		files, err := fo.oldFiles(dir, false)
+		if err != nil {
+			log.Println("Error listing rotated files: ", err)
+		}
+		for len(files) > fo.MaxOldFiles {
+			remove(files[0].path)
+			files = files[1:]
+		}
+	}
+
+	if fo.MaxTotalBytes > 0 {
+		files, err := fo.oldFiles(filepath.Dir(fo.Path), true)
+		if err != nil {
+			log.Println("Error listing rotated files: ", err)
+		}
+		var total int64
+		for _, file := range files {
+			total += file.size
+		}
+		for _, file := range files {
+			if total <= fo.MaxTotalBytes {
+				break
+			}
+			remove(file.path)
+			total -= file.size
+		}
+	}
+}
+
+// Lists the rotated files in dir, and below it if recursive, oldest first
+func (fo *FileOutput) oldFiles(dir string, recursive bool) ([]oldFile, error) {
+	stem, ext := splitExt(filepath.Base(fo.Path))
+	var files []oldFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, stem+"-") && strings.HasSuffix(name, ext) && len(name) > len(stem)+1+len(ext) {
+			files = append(files, oldFile{path: path, size: info.Size()})
+		}
+		return nil
+	})
+	// Names are the rotation time, which is the order across categories too
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i].path) < filepath.Base(files[j].path)
+	})
+	return files, err
+}
+
+// Turns a category into a relative path that can't escape the directory it is joined to
+func categoryPath(category string) string {
+	var parts []string
+	for _, part := range strings.Split(category, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			part = "_"
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "_"
+	}
+	return filepath.Join(parts...)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fo := &FileOutput{Path: filepath.Join(dir, DefaultFileOutputPath)}
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("one", "two")))
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("three")))
+
+	b, err := ioutil.ReadFile(fo.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\nthree\n", string(b))
+}
+
+func newTestFileOutput(t *testing.T, name string) *FileOutput {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	now := time.Date(2019, 7, 19, 12, 0, 0, 0, time.UTC)
+	return &FileOutput{
+		Path: filepath.Join(dir, name),
+		now: func() time.Time {
+			// Every rotated file gets a different name
+			now = now.Add(time.Second)
+			return now
+		},
+	}
+}
+
+// Returns the contents of the rotated files in dir, oldest first, then the current
+// file's, if there is one
+func readFileOutput(t *testing.T, fo *FileOutput, dir string) []string {
+	files, err := fo.oldFiles(dir, false)
+	assert.NoError(t, err)
+	current := filepath.Join(dir, filepath.Base(fo.Path))
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, oldFile{path: current})
+	}
+	var contents []string
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		assert.NoError(t, err)
+		var b []byte
+		if fo.Compress {
+			gz, err := gzip.NewReader(f)
+			assert.NoError(t, err)
+			b, err = ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+		} else {
+			b, err = ioutil.ReadAll(f)
+			assert.NoError(t, err)
+		}
+		f.Close()
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestFileOutputPerCategory(t *testing.T) {
+	fo := newTestFileOutput(t, "archive.log")
+	dir := filepath.Dir(fo.Path)
+	defer os.RemoveAll(dir)
+	fo.PerCategory = true
+
+	kubelet := MetadataValues{category: "prod/systemd/kubelet"}
+	nginx := MetadataValues{category: "prod/docker/nginx"}
+	assert.NoError(t, fo.Send(context.Background(), kubelet, testEntries("one", "two")))
+	assert.NoError(t, fo.Send(context.Background(), nginx, testEntries("three")))
+	assert.NoError(t, fo.Send(context.Background(), kubelet, testEntries("four")))
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{category: "../../etc"}, testEntries("five")))
+
+	assert.Equal(t, []string{"one\ntwo\nfour\n"}, readFileOutput(t, fo, filepath.Join(dir, "prod/systemd/kubelet")))
+	assert.Equal(t, []string{"three\n"}, readFileOutput(t, fo, filepath.Join(dir, "prod/docker/nginx")))
+	assert.Equal(t, []string{"five\n"}, readFileOutput(t, fo, filepath.Join(dir, "_/_/etc")))
+}
+
+func TestFileOutputCompress(t *testing.T) {
+	fo := newTestFileOutput(t, "archive.log.gz")
+	dir := filepath.Dir(fo.Path)
+	defer os.RemoveAll(dir)
+	fo.Compress = true
+	fo.MaxBytes = 1
+
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("one", "two")))
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("three")))
+
+	files, err := fo.oldFiles(dir, false)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0].path, ".log.gz"))
+	assert.Equal(t, []string{"one\ntwo\n", "three\n"}, readFileOutput(t, fo, dir))
+
+	// One gzip member per batch, read as one
+	fo.MaxBytes = 0
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("four")))
+	assert.Equal(t, []string{"one\ntwo\n", "three\nfour\n"}, readFileOutput(t, fo, dir))
+}
+
+func TestFileOutputRotation(t *testing.T) {
+	fo := newTestFileOutput(t, "archive.log")
+	dir := filepath.Dir(fo.Path)
+	defer os.RemoveAll(dir)
+	fo.MaxBytes = 8
+	fo.MaxAge = time.Minute
+
+	// By size
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("one", "two")))
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("three")))
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("four")))
+	assert.Equal(t, []string{"one\ntwo\n", "three\nfour\n"}, readFileOutput(t, fo, dir))
+
+	// By age
+	now := fo.now()
+	fo.now = func() time.Time { return now.Add(time.Hour) }
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("five")))
+	assert.Equal(t, []string{"one\ntwo\n", "three\nfour\n", "five\n"}, readFileOutput(t, fo, dir))
+
+	// Carries on with the same file after a restart
+	fo = &FileOutput{Path: fo.Path, MaxBytes: 8}
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{}, testEntries("six")))
+	assert.Equal(t, []string{"one\ntwo\n", "three\nfour\n", "five\nsix\n"}, readFileOutput(t, fo, dir))
+}
+
+func TestFileOutputRetention(t *testing.T) {
+	fo := newTestFileOutput(t, "archive.log")
+	dir := filepath.Dir(fo.Path)
+	defer os.RemoveAll(dir)
+	fo.PerCategory = true
+	fo.MaxBytes = 1
+	fo.MaxOldFiles = 1
+
+	for _, message := range []string{"one", "two", "three"} {
+		assert.NoError(t, fo.Send(context.Background(), MetadataValues{category: "a"}, testEntries(message)))
+	}
+	assert.Equal(t, []string{"two\n", "three\n"}, readFileOutput(t, fo, filepath.Join(dir, "a")))
+
+	// Total bytes is across categories, and never counts the files being written to
+	fo.MaxOldFiles = 0
+	fo.MaxTotalBytes = 5
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{category: "b"}, testEntries("four")))
+	assert.NoError(t, fo.Send(context.Background(), MetadataValues{category: "b"}, testEntries("five")))
+	assert.Equal(t, []string{"three\n"}, readFileOutput(t, fo, filepath.Join(dir, "a")))
+	assert.Equal(t, []string{"four\n", "five\n"}, readFileOutput(t, fo, filepath.Join(dir, "b")))
+}
+
+func TestCategoryPath(t *testing.T) {
+	assert.Equal(t, filepath.Join("prod", "kubernetes", "kube-system", "kube-proxy"), categoryPath("prod/kubernetes/kube-system/kube-proxy"))
+	assert.Equal(t, filepath.Join("_", "etc"), categoryPath("/../etc/."))
+	assert.Equal(t, "_", categoryPath(""))
+}
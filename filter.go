@@ -1,6 +1,10 @@
 package main
 
-import "github.com/coreos/go-systemd/sdjournal"
+import (
+	"github.com/coreos/go-systemd/sdjournal"
+	"sort"
+	"strings"
+)
 
 // Filtering for log messages
 // See: https://www.freedesktop.org/software/systemd/man/systemd.journal-fields.html
@@ -9,12 +13,55 @@ import "github.com/coreos/go-systemd/sdjournal"
 type FilterFn func(e *sdjournal.JournalEntry) bool
 
 type FilterChain struct {
-	funcs []FilterFn
+	funcs   []FilterFn
+	matches [][]JournalMatch // journal matches for each of funcs, nil where it has none
+	exact   []bool           // whether those matches are equivalent to the func
 }
 
+// JournalMatch is a set of "FIELD=value" terms installed with sd_journal_add_match.
+// As in sd_journal_add_match(3), terms on the same field are ORed and terms on
+// different fields are ANDed. A list of JournalMatch is a disjunction.
+type JournalMatch []string
+
 // Add a filter function to the filter chain
 func (fs *FilterChain) AddFilter(fn FilterFn) {
+	fs.AddMatchFilter(fn, nil, false)
+}
+
+// Add a filter function that the journal can also apply, by only returning entries
+// that satisfy any of matches. If exact, the journal matches do the whole job and fn
+// won't need to be called once they have been pushed down; otherwise they only
+// narrow down what fn has to look at.
+func (fs *FilterChain) AddMatchFilter(fn FilterFn, matches []JournalMatch, exact bool) {
 	fs.funcs = append(fs.funcs, fn)
+	fs.matches = append(fs.matches, matches)
+	fs.exact = append(fs.exact, exact && matches != nil)
+}
+
+// Splits the chain into the journal matches that can be installed with AddMatch and
+// AddDisjunction, and a chain of whatever filters the journal can't apply itself.
+// Returns nil matches if the journal can't do any of the filtering.
+func (fs *FilterChain) PushDown() ([]JournalMatch, *FilterChain) {
+	var matches []JournalMatch
+	rest := &FilterChain{}
+	for i, fn := range fs.funcs {
+		if fs.matches[i] != nil {
+			if matches == nil {
+				matches = fs.matches[i]
+			} else {
+				matches = andJournalMatches(matches, fs.matches[i])
+			}
+		}
+		if !fs.exact[i] {
+			rest.AddMatchFilter(fn, fs.matches[i], false)
+		}
+	}
+	if matches != nil && len(matches) == 0 {
+		// Contradictory, nothing can get through. The journal treats no matches as
+		// match everything, so leave it to the filters.
+		return nil, fs
+	}
+	return matches, rest
 }
 
 // Returns true iff all the filters in the stack return true
@@ -35,6 +82,76 @@ func FilterByTransport(desiredTransports []string) FilterFn {
 	}
 }
 
+// Returns journal matches equivalent to FilterByTransport
+func TransportMatches(desiredTransports []string) []JournalMatch {
+	return fieldMatches("_TRANSPORT", desiredTransports)
+}
+
+func fieldMatches(field string, values []string) []JournalMatch {
+	if len(values) == 0 {
+		return []JournalMatch{}
+	}
+	match := JournalMatch{}
+	for _, v := range values {
+		match = append(match, field+"="+v)
+	}
+	return []JournalMatch{match}
+}
+
+// Returns the disjunction equivalent to a AND b, by distributing: (a1 OR a2) AND (b1 OR b2)
+// is (a1 AND b1) OR (a1 AND b2) OR ...
+func andJournalMatches(a []JournalMatch, b []JournalMatch) []JournalMatch {
+	r := []JournalMatch{}
+	for _, x := range a {
+		for _, y := range b {
+			if m, ok := andJournalMatch(x, y); ok {
+				r = append(r, m)
+			}
+		}
+	}
+	return r
+}
+
+// Combines two matches with AND. Where both constrain the same field, only values
+// allowed by both survive, if there are none then nothing can match and ok is false.
+func andJournalMatch(x JournalMatch, y JournalMatch) (JournalMatch, bool) {
+	xFields := splitJournalMatch(x)
+	yFields := splitJournalMatch(y)
+	var r JournalMatch
+	for field, xValues := range xFields {
+		values := xValues
+		if yValues, found := yFields[field]; found {
+			values = ListIntersect(xValues, yValues)
+			if len(values) == 0 {
+				return nil, false
+			}
+		}
+		for _, v := range values {
+			r = append(r, field+"="+v)
+		}
+	}
+	for field, yValues := range yFields {
+		if _, found := xFields[field]; !found {
+			for _, v := range yValues {
+				r = append(r, field+"="+v)
+			}
+		}
+	}
+	sort.Strings(r)
+	return r, true
+}
+
+func splitJournalMatch(m JournalMatch) map[string][]string {
+	fields := map[string][]string{}
+	for _, term := range m {
+		bits := strings.SplitN(term, "=", 2)
+		if len(bits) == 2 {
+			fields[bits[0]] = append(fields[bits[0]], bits[1])
+		}
+	}
+	return fields
+}
+
 //Returns a filter that filters out specific service / unit names, useful to exclude the logs of the logfwder itself
 func ExcludeBySystemDUnit(excludedUnits []string) FilterFn {
 	return func(e *sdjournal.JournalEntry) bool {
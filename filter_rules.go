@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// Filter rules are loaded from a JSON file, e.g:
+//
+//	{
+//	  "default": "include",
+//	  "rules": [
+//	    {"action": "exclude", "match": [{"field": "PRIORITY", "min": 7}]},
+//	    {"action": "include", "match": [{"metadata": "namespace", "equals": "kube-system"},
+//	                                    {"field": "SYSLOG_IDENTIFIER", "glob": "kube-proxy*"}]},
+//	    {"action": "exclude", "match": [{"metadata": "namespace", "equals": "kube-system"}]}
+//	  ]
+//	}
+//
+// Rules are tried in order and the first one whose conditions all match decides
+// whether an entry is included or excluded. If no rule matches, the default applies.
+type FilterRules struct {
+	Default string       `json:"default"`
+	Rules   []FilterRule `json:"rules"`
+}
+
+type FilterRule struct {
+	Action string            `json:"action"`
+	Match  []FilterCondition `json:"match"`
+}
+
+// A condition tests either a journal field or a piece of derived metadata, with
+// exactly one of equals, glob or regex, or with a numeric min and/or max (inclusive).
+// A missing field is treated as an empty string, and never satisfies min/max.
+type FilterCondition struct {
+	Field    string  `json:"field,omitempty"`
+	Metadata string  `json:"metadata,omitempty"` // category, source or namespace
+	Equals   *string `json:"equals,omitempty"`
+	Glob     string  `json:"glob,omitempty"` // * and ? only, * also matches /
+	Regex    string  `json:"regex,omitempty"`
+	Min      *int    `json:"min,omitempty"`
+	Max      *int    `json:"max,omitempty"`
+}
+
+// Looks up the metadata that an entry will be sent with
+type MetadataLookup func(e *sdjournal.JournalEntry) MetadataValues
+
+func LoadFilterRules(path string) (*FilterRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules FilterRules
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &rules, nil
+}
+
+// Compiles the rules to a filter. lookup is only called for rules that match on metadata.
+func (rs *FilterRules) Compile(lookup MetadataLookup) (FilterFn, error) {
+	want, err := parseFilterAction(rs.Default, true)
+	if err != nil {
+		return nil, fmt.Errorf("default: %s", err)
+	}
+
+	type compiledRule struct {
+		include bool
+		match   []func(e *sdjournal.JournalEntry) bool
+	}
+	var compiled []compiledRule
+	for i, rule := range rs.Rules {
+		include, err := parseFilterAction(rule.Action, false)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		cr := compiledRule{include: include}
+		for _, cond := range rule.Match {
+			fn, err := cond.compile(lookup)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+			cr.match = append(cr.match, fn)
+		}
+		compiled = append(compiled, cr)
+	}
+
+	return func(e *sdjournal.JournalEntry) bool {
+	NextRule:
+		for _, rule := range compiled {
+			for _, fn := range rule.match {
+				if !fn(e) {
+					continue NextRule
+				}
+			}
+			return rule.include
+		}
+		return want
+	}, nil
+}
+
+// Returns journal matches that let through at least everything the rules would
+// include, and whether they are exact, i.e. let through nothing the rules wouldn't.
+// Returns nil if the journal can't help, which is the case unless the default is
+// exclude and every include rule has an exact match on some journal field.
+func (rs *FilterRules) JournalMatches() ([]JournalMatch, bool) {
+	if rs.Default != "exclude" {
+		return nil, false
+	}
+	exact := true
+	matches := []JournalMatch{}
+	for _, rule := range rs.Rules {
+		if rule.Action != "include" {
+			// Only narrows things further, the journal can't do that for us
+			exact = false
+			continue
+		}
+		var match JournalMatch
+		fields := map[string]bool{}
+		for _, cond := range rule.Match {
+			if cond.Field == "" || cond.Equals == nil || *cond.Equals == "" || fields[cond.Field] {
+				// The journal can't do this condition, or can't AND it with the one before
+				// (terms on the same field are ORed)
+				exact = false
+				continue
+			}
+			fields[cond.Field] = true
+			match = append(match, cond.Field+"="+*cond.Equals)
+		}
+		if len(match) == 0 {
+			// Could include anything
+			return nil, false
+		}
+		matches = append(matches, match)
+	}
+	return matches, exact
+}
+
+func parseFilterAction(action string, allowEmpty bool) (bool, error) {
+	switch action {
+	case "include":
+		return true, nil
+	case "exclude":
+		return false, nil
+	case "":
+		if allowEmpty {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("action must be include or exclude, not %q", action)
+}
+
+func (cond FilterCondition) compile(lookup MetadataLookup) (func(e *sdjournal.JournalEntry) bool, error) {
+	var value func(e *sdjournal.JournalEntry) (string, bool)
+	switch {
+	case cond.Field != "" && cond.Metadata != "":
+		return nil, fmt.Errorf("condition has both field and metadata")
+	case cond.Field != "":
+		value = func(e *sdjournal.JournalEntry) (string, bool) {
+			v, ok := e.Fields[cond.Field]
+			return v, ok
+		}
+	case cond.Metadata != "":
+		get, err := metadataGetter(cond.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		value = func(e *sdjournal.JournalEntry) (string, bool) {
+			return get(lookup(e)), true
+		}
+	default:
+		return nil, fmt.Errorf("condition needs a field or metadata")
+	}
+
+	var test func(v string, ok bool) bool
+	tests := 0
+	if cond.Equals != nil {
+		tests++
+		test = func(v string, ok bool) bool {
+			return v == *cond.Equals
+		}
+	}
+	if cond.Glob != "" {
+		tests++
+		re, err := regexp.Compile(globToRegexp(cond.Glob))
+		if err != nil {
+			return nil, err
+		}
+		test = func(v string, ok bool) bool {
+			return re.MatchString(v)
+		}
+	}
+	if cond.Regex != "" {
+		tests++
+		re, err := regexp.Compile(cond.Regex)
+		if err != nil {
+			return nil, err
+		}
+		test = func(v string, ok bool) bool {
+			return re.MatchString(v)
+		}
+	}
+	if cond.Min != nil || cond.Max != nil {
+		tests++
+		test = func(v string, ok bool) bool {
+			n, err := strconv.Atoi(v)
+			if !ok || err != nil {
+				return false
+			}
+			return (cond.Min == nil || n >= *cond.Min) && (cond.Max == nil || n <= *cond.Max)
+		}
+	}
+	if tests != 1 {
+		return nil, fmt.Errorf("condition needs exactly one of equals, glob, regex or min/max")
+	}
+
+	return func(e *sdjournal.JournalEntry) bool {
+		return test(value(e))
+	}, nil
+}
+
+func metadataGetter(name string) (func(m MetadataValues) string, error) {
+	switch name {
+	case "category":
+		return func(m MetadataValues) string { return m.category }, nil
+	case "source":
+		return func(m MetadataValues) string { return m.source }, nil
+	case "namespace":
+		return func(m MetadataValues) string { return m.namespace }, nil
+	}
+	return nil, fmt.Errorf("unknown metadata %q, expected category, source or namespace", name)
+}
+
+// Converts a glob to an anchored regexp. Unlike path.Match, * matches across / so
+// that globs are useful on categories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func compileTestRules(t *testing.T, rulesJSON string) FilterFn {
+	f, err := ioutil.TempFile("", "filter-rules")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(rulesJSON)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	rules, err := LoadFilterRules(f.Name())
+	assert.NoError(t, err)
+	fn, err := rules.Compile(func(e *sdjournal.JournalEntry) MetadataValues {
+		// Pretend kernel messages come from a kubernetes namespace
+		if e.Fields["_TRANSPORT"] == "kernel" {
+			return MetadataValues{category: "base/kubernetes/kube-system/kernel", source: "kernel", namespace: "kube-system"}
+		}
+		return MetadataValues{category: "base/journald/journal", source: "journal"}
+	})
+	assert.NoError(t, err)
+	return fn
+}
+
+func TestFilterRulesDefault(t *testing.T) {
+	fn := compileTestRules(t, `{"rules": []}`)
+	assert.True(t, fn(&msg1))
+
+	fn = compileTestRules(t, `{"default": "exclude", "rules": []}`)
+	assert.False(t, fn(&msg1))
+}
+
+func TestFilterRulesFirstMatchWins(t *testing.T) {
+	fn := compileTestRules(t, `{
+		"default": "exclude",
+		"rules": [
+			{"action": "exclude", "match": [{"field": "_SYSTEMD_UNIT", "equals": "test.service"}]},
+			{"action": "include", "match": [{"field": "_TRANSPORT", "equals": "kernel"}]}
+		]
+	}`)
+	assert.True(t, fn(&msg1))
+	assert.False(t, fn(&msg2)) // no rule matches, default
+	assert.False(t, fn(&msg3)) // kernel, but the unit rule comes first
+}
+
+func TestFilterRulesMatchTypes(t *testing.T) {
+	fn := compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "SYSLOG_IDENTIFIER", "glob": "systemd-*"}]}
+	]}`)
+	assert.True(t, fn(&msg1))
+	assert.False(t, fn(&msg2))
+
+	fn = compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "MESSAGE", "regex": "fq_codel"}]}
+	]}`)
+	assert.True(t, fn(&msg1))
+	assert.False(t, fn(&msg2))
+
+	// Missing fields are empty
+	fn = compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "_SYSTEMD_UNIT", "equals": ""}]}
+	]}`)
+	assert.False(t, fn(&msg1))
+	assert.True(t, fn(&msg3))
+}
+
+func TestFilterRulesPriority(t *testing.T) {
+	fn := compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "PRIORITY", "min": 5, "max": 7}]}
+	]}`)
+	assert.False(t, fn(&msg1))
+	assert.False(t, fn(&msg2))
+
+	fn = compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "PRIORITY", "min": 6}]}
+	]}`)
+	assert.True(t, fn(&msg1))
+
+	// Not a number, or not there at all, never matches a range
+	fn = compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "_HOSTNAME", "max": 10}]},
+		{"action": "exclude", "match": [{"field": "NOT_A_FIELD", "max": 10}]}
+	]}`)
+	assert.True(t, fn(&msg1))
+}
+
+func TestFilterRulesMetadata(t *testing.T) {
+	fn := compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"metadata": "namespace", "equals": "kube-system"}]}
+	]}`)
+	assert.False(t, fn(&msg1))
+	assert.True(t, fn(&msg2))
+
+	fn = compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"metadata": "category", "glob": "*/kubernetes/*"}, {"metadata": "source", "equals": "kernel"}]}
+	]}`)
+	assert.False(t, fn(&msg1))
+	assert.True(t, fn(&msg2))
+}
+
+func TestFilterRulesInFilterChain(t *testing.T) {
+	fc := FilterChain{}
+	fc.AddFilter(FilterByTransport([]string{"kernel", "journal"}))
+	fc.AddFilter(compileTestRules(t, `{"rules": [
+		{"action": "exclude", "match": [{"field": "_SYSTEMD_UNIT", "glob": "*.service"}]}
+	]}`))
+	assert.True(t, fc.Want(&msg1))
+	assert.True(t, fc.Want(&msg2))
+	assert.False(t, fc.Want(&msg3))
+}
+
+func TestFilterRulesInvalid(t *testing.T) {
+	for _, rulesJSON := range []string{
+		`{"rules": [{"action": "drop", "match": []}]}`,
+		`{"rules": [{"action": "exclude", "match": [{"equals": "x"}]}]}`,
+		`{"rules": [{"action": "exclude", "match": [{"field": "A", "metadata": "category", "equals": "x"}]}]}`,
+		`{"rules": [{"action": "exclude", "match": [{"field": "A"}]}]}`,
+		`{"rules": [{"action": "exclude", "match": [{"field": "A", "equals": "x", "regex": "y"}]}]}`,
+		`{"rules": [{"action": "exclude", "match": [{"field": "A", "regex": "("}]}]}`,
+		`{"rules": [{"action": "exclude", "match": [{"metadata": "colour", "equals": "x"}]}]}`,
+	} {
+		rules := &FilterRules{}
+		assert.NoError(t, json.Unmarshal([]byte(rulesJSON), rules))
+		_, err := rules.Compile(nil)
+		assert.Error(t, err, rulesJSON)
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	assert.Equal(t, `^docker.*\.service$`, globToRegexp("docker*.service"))
+	assert.Equal(t, `^a.c$`, globToRegexp("a?c"))
+}
+
+func TestFilterRulesJournalMatches(t *testing.T) {
+	rules := &FilterRules{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"default": "exclude",
+		"rules": [
+			{"action": "include", "match": [{"field": "_SYSTEMD_UNIT", "equals": "kubelet.service"}]},
+			{"action": "include", "match": [{"field": "_TRANSPORT", "equals": "kernel"}, {"field": "PRIORITY", "equals": "0"}]}
+		]
+	}`), rules))
+	matches, exact := rules.JournalMatches()
+	assert.True(t, exact)
+	assert.Equal(t, []JournalMatch{
+		{"_SYSTEMD_UNIT=kubelet.service"},
+		{"_TRANSPORT=kernel", "PRIORITY=0"},
+	}, matches)
+
+	// An exclude rule or a non-exact condition means the journal can only narrow things down
+	rules = &FilterRules{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"default": "exclude",
+		"rules": [
+			{"action": "exclude", "match": [{"field": "PRIORITY", "min": 7}]},
+			{"action": "include", "match": [{"field": "_TRANSPORT", "equals": "kernel"}, {"field": "MESSAGE", "regex": "oom"}]}
+		]
+	}`), rules))
+	matches, exact = rules.JournalMatches()
+	assert.False(t, exact)
+	assert.Equal(t, []JournalMatch{{"_TRANSPORT=kernel"}}, matches)
+
+	// Default include, or an include rule the journal can't express, could let anything through
+	for _, rulesJSON := range []string{
+		`{"rules": [{"action": "include", "match": [{"field": "_TRANSPORT", "equals": "kernel"}]}]}`,
+		`{"default": "exclude", "rules": [{"action": "include", "match": [{"metadata": "namespace", "equals": "x"}]}]}`,
+	} {
+		rules = &FilterRules{}
+		assert.NoError(t, json.Unmarshal([]byte(rulesJSON), rules))
+		matches, _ = rules.JournalMatches()
+		assert.Nil(t, matches, rulesJSON)
+	}
+}
@@ -83,3 +83,48 @@ func TestFilterChain(t *testing.T) {
 	assert.True(t, fc.Want(&msg2))
 	assert.False(t, fc.Want(&msg3))
 }
+
+func TestFilterChainPushDown(t *testing.T) {
+	fc := &FilterChain{}
+	fc.AddMatchFilter(FilterByTransport([]string{"kernel", "journal"}), TransportMatches([]string{"kernel", "journal"}), true)
+	fc.AddMatchFilter(func(e *sdjournal.JournalEntry) bool {
+		return e.Fields["_SYSTEMD_UNIT"] == "test.service"
+	}, []JournalMatch{{"_SYSTEMD_UNIT=test.service"}}, true)
+	fc.AddFilter(ExcludeBySystemDUnit([]string{"other.service"}))
+
+	matches, rest := fc.PushDown()
+	assert.Equal(t, []JournalMatch{{"_SYSTEMD_UNIT=test.service", "_TRANSPORT=journal", "_TRANSPORT=kernel"}}, matches)
+
+	// Only the exclusion is left for us to do, the journal won't return anything but test.service
+	assert.Len(t, rest.funcs, 1)
+	assert.True(t, rest.Want(&msg3))
+	assert.True(t, rest.Want(&msg1))
+	other := sdjournal.JournalEntry{Fields: map[string]string{"_SYSTEMD_UNIT": "other.service", "_TRANSPORT": "journal"}}
+	assert.False(t, rest.Want(&other))
+}
+
+func TestFilterChainPushDownNothing(t *testing.T) {
+	fc := &FilterChain{}
+	fc.AddFilter(ExcludeBySystemDUnit([]string{"test.service"}))
+	matches, rest := fc.PushDown()
+	assert.Nil(t, matches)
+	assert.False(t, rest.Want(&msg3))
+
+	// Contradictory matches can't be installed, the journal would return everything
+	fc = &FilterChain{}
+	fc.AddMatchFilter(FilterByTransport([]string{"kernel"}), TransportMatches([]string{"kernel"}), true)
+	fc.AddMatchFilter(FilterByTransport([]string{"journal"}), TransportMatches([]string{"journal"}), true)
+	matches, rest = fc.PushDown()
+	assert.Nil(t, matches)
+	assert.False(t, rest.Want(&msg1))
+	assert.False(t, rest.Want(&msg2))
+}
+
+func TestAndJournalMatches(t *testing.T) {
+	a := []JournalMatch{{"_TRANSPORT=kernel", "_TRANSPORT=journal"}, {"_SYSTEMD_UNIT=a.service"}}
+	b := []JournalMatch{{"_TRANSPORT=journal", "_TRANSPORT=stdout"}}
+	assert.Equal(t, []JournalMatch{
+		{"_TRANSPORT=journal"},
+		{"_SYSTEMD_UNIT=a.service", "_TRANSPORT=journal", "_TRANSPORT=stdout"},
+	}, andJournalMatches(a, b))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// FluentdOutput sends entries to fluentd or fluent-bit with the forward protocol, in
+// PackedForward mode, tagged with their category.
+// See: https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+//
+// Each batch is sent with a chunk id, and is only delivered once the server acks it.
+type FluentdOutput struct {
+	Addr string // host:port, fluentd's default is 24224
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (f *FluentdOutput) Name() string {
+	return "fluentd"
+}
+
+func (f *FluentdOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	chunk, err := fluentdChunkID()
+	if err != nil {
+		return err
+	}
+	msg := fluentdMessage(metadata, batch, chunk)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", f.Addr)
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+		f.reader = bufio.NewReader(conn)
+	}
+
+	done := CloseOnDone(ctx, f.conn)
+	err = f.sendAndWaitForAck(msg, chunk)
+	cancelled := done()
+	if cancelled && err != nil {
+		err = ctx.Err()
+	}
+	if err != nil || cancelled {
+		// Start again with a new connection, so a late ack can't be mistaken for the next one
+		_ = f.conn.Close()
+		f.conn = nil
+		f.reader = nil
+	}
+	return err
+}
+
+func (f *FluentdOutput) sendAndWaitForAck(msg []byte, chunk string) error {
+	_, err := f.conn.Write(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := msgpackReadStringMap(f.reader)
+	if err != nil {
+		return fmt.Errorf("error reading fluentd ack: %s", err)
+	}
+	if resp["ack"] != chunk {
+		return fmt.Errorf("fluentd acked chunk %q, expected %q", resp["ack"], chunk)
+	}
+	return nil
+}
+
+// Builds a PackedForward message: [tag, entries, {"chunk": chunk, "size": len(batch)}],
+// where entries is a binary string of [time, record] entries one after the other.
+func fluentdMessage(metadata MetadataValues, batch []LogEntry, chunk string) []byte {
+	var entries []byte
+	for _, entry := range batch {
+		entries = msgpackAppendArrayHeader(entries, 2)
+		entries = msgpackAppendEventTime(entries, entryTime(entry))
+		entries = msgpackAppendStringMap(entries, fluentdRecord(metadata, entry))
+	}
+
+	msg := msgpackAppendArrayHeader(nil, 3)
+	msg = msgpackAppendString(msg, metadata.category)
+	msg = msgpackAppendBinary(msg, entries)
+	msg = msgpackAppendMapHeader(msg, 2)
+	msg = msgpackAppendString(msg, "chunk")
+	msg = msgpackAppendString(msg, chunk)
+	msg = msgpackAppendString(msg, "size")
+	msg = msgpackAppendInt(msg, len(batch))
+	return msg
+}
+
+func fluentdRecord(metadata MetadataValues, entry LogEntry) map[string]string {
+	record := map[string]string{
+		"message": entry.Message,
+		"host":    metadata.host,
+		"source":  metadata.source,
+	}
+	for name, value := range map[string]string{
+		"namespace": metadata.namespace,
+		"pod":       metadata.pod,
+		"owner":     metadata.owner,
+		"container": metadata.container,
+	} {
+		if value != "" {
+			record[name] = value
+		}
+	}
+	return record
+}
+
+// Chunk ids just have to be unique, fluentd suggests a base64 encoded 128 bit random number
+func fluentdChunkID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(id), nil
+}
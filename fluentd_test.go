@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Decodes the msgpack types we send, with EventTime as a time.Time
+func msgpackDecode(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	decodeArray := func(n int) (interface{}, error) {
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = msgpackDecode(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	decodeMap := func(n int) (interface{}, error) {
+		m := map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			k, err := msgpackDecode(r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := msgpackDecode(r)
+			if err != nil {
+				return nil, err
+			}
+			m[k.(string)] = v
+		}
+		return m, nil
+	}
+	switch {
+	case c < 0x80:
+		return int(c), nil
+	case c&0xf0 == 0x80:
+		return decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return decodeArray(int(c & 0x0f))
+	case c == 0xde || c == 0xdc:
+		n, err := msgpackReadLength(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if c == 0xde {
+			return decodeMap(n)
+		}
+		return decodeArray(n)
+	case c&0xe0 == 0xa0, c == 0xd9, c == 0xda, c == 0xdb:
+		_ = r.UnreadByte()
+		return msgpackReadString(r)
+	case c == 0xc4 || c == 0xc5 || c == 0xc6:
+		_ = r.UnreadByte()
+		s, err := msgpackReadString(r)
+		return []byte(s), err
+	case c == 0xd3:
+		b, err := readN(8)
+		return int(int64(binary.BigEndian.Uint64(b))), err
+	case c == 0xd7:
+		b, err := readN(9)
+		if err != nil || b[0] != 0 {
+			return nil, fmt.Errorf("not an EventTime")
+		}
+		return time.Unix(int64(binary.BigEndian.Uint32(b[1:5])), int64(binary.BigEndian.Uint32(b[5:9]))).UTC(), nil
+	default:
+		return nil, fmt.Errorf("unexpected msgpack type 0x%x", c)
+	}
+}
+
+// testFluentd is a forward input that acks with whatever ack returns
+type testFluentd struct {
+	net.Listener
+	ack func(chunk string) string
+
+	mu       sync.Mutex
+	messages [][]interface{}
+	conns    int
+}
+
+func newTestFluentd(t *testing.T) *testFluentd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	f := &testFluentd{Listener: l, ack: func(chunk string) string { return chunk }}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(t, conn)
+		}
+	}()
+	return f
+}
+
+func (f *testFluentd) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := msgpackDecode(r)
+		if err != nil {
+			return
+		}
+		message := msg.([]interface{})
+		f.mu.Lock()
+		f.messages = append(f.messages, message)
+		ack := f.ack(message[2].(map[string]interface{})["chunk"].(string))
+		f.mu.Unlock()
+		_, _ = conn.Write(msgpackAppendStringMap(nil, map[string]string{"ack": ack}))
+	}
+}
+
+func (f *testFluentd) Messages() [][]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.messages
+}
+
+func (f *testFluentd) Conns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+func TestFluentdPackedForward(t *testing.T) {
+	server := newTestFluentd(t)
+	defer server.Close()
+	fluentd := &FluentdOutput{Addr: server.Addr().String()}
+
+	metadata := MetadataValues{category: "prod/systemd/kubelet", source: "kubelet", host: "node-1"}
+	batch := testEntries("one", "two")
+	batch[0].Timestamp = 1563537600123456
+	batch[1].Timestamp = 1563537601000000
+	assert.NoError(t, fluentd.Send(context.Background(), metadata, batch))
+
+	messages := server.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "prod/systemd/kubelet", messages[0][0])
+	assert.Equal(t, 2, messages[0][2].(map[string]interface{})["size"])
+
+	// The entries are a binary string of [time, record] one after the other
+	r := bufio.NewReader(bytes.NewReader(messages[0][1].([]byte)))
+	var entries []interface{}
+	for {
+		entry, err := msgpackDecode(r)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	record := func(message string) map[string]interface{} {
+		return map[string]interface{}{"message": message, "host": "node-1", "source": "kubelet"}
+	}
+	assert.Equal(t, []interface{}{
+		[]interface{}{time.Date(2019, 7, 19, 12, 0, 0, 123456000, time.UTC), record("one")},
+		[]interface{}{time.Date(2019, 7, 19, 12, 0, 1, 0, time.UTC), record("two")},
+	}, entries)
+
+	// Same connection next time
+	assert.NoError(t, fluentd.Send(context.Background(), metadata, batch))
+	assert.Len(t, server.Messages(), 2)
+	assert.Equal(t, 1, server.Conns())
+}
+
+func TestFluentdWrongAck(t *testing.T) {
+	server := newTestFluentd(t)
+	defer server.Close()
+	server.ack = func(chunk string) string { return "something else" }
+	fluentd := &FluentdOutput{Addr: server.Addr().String()}
+
+	assert.Error(t, fluentd.Send(context.Background(), MetadataValues{}, testEntries("one")))
+	assert.Nil(t, fluentd.conn)
+
+	server.mu.Lock()
+	server.ack = func(chunk string) string { return chunk }
+	server.mu.Unlock()
+	assert.NoError(t, fluentd.Send(context.Background(), MetadataValues{}, testEntries("one")))
+	assert.Equal(t, 2, server.Conns())
+}
+
+func TestFluentdAckTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		// Read everything, never ack
+		conn, err := l.Accept()
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	fluentd := &FluentdOutput{Addr: l.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, fluentd.Send(ctx, MetadataValues{}, testEntries("one")))
+}
+
+func TestMsgpackLengths(t *testing.T) {
+	for _, n := range []int{0, 31, 32, 255, 256, 65535, 65536} {
+		s := string(make([]byte, n))
+		r := bufio.NewReader(bytes.NewReader(msgpackAppendString(nil, s)))
+		decoded, err := msgpackReadString(r)
+		assert.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+}
+
+func TestFluentdCancelled(t *testing.T) {
+	l := newStuckPeer(t)
+	defer l.Close()
+	assertSendCancels(t, &FluentdOutput{Addr: l.Addr().String()})
+}
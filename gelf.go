@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultGELFFields    = "SYSLOG_IDENTIFIER,_PID,_SYSTEMD_UNIT"
+	DefaultGELFChunkSize = 1420 // fits in a typical MTU
+
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+// GELFOutput sends entries to Graylog as GELF 1.1 messages, over TCP with each
+// message terminated by a null byte, or over UDP gzipped and chunked.
+// See: https://go2docs.graylog.org/current/getting_in_log_data/gelf.html
+//
+// MESSAGE is the short_message, PRIORITY the level, and the metadata and the journal
+// fields in Fields are additional fields, e.g. _PID becomes _pid.
+type GELFOutput struct {
+	Addr      string   // host:port
+	Protocol  string   // tcp or udp
+	Fields    []string // journal fields to send as additional fields
+	ChunkSize int      // largest UDP datagram to send, including the chunk header
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (g *GELFOutput) Name() string {
+	return "gelf"
+}
+
+func (g *GELFOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, g.Protocol, g.Addr)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+
+	done := CloseOnDone(ctx, g.conn)
+	var err error
+	if g.Protocol == "udp" {
+		err = g.sendUDP(metadata, batch)
+	} else {
+		err = g.sendTCP(metadata, batch)
+	}
+	cancelled := done()
+	_, partial := err.(*PartialError)
+	if cancelled && err != nil && !partial {
+		err = ctx.Err()
+	}
+	if cancelled || (err != nil && !partial) {
+		// Start again with a new connection
+		_ = g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
+
+func (g *GELFOutput) sendTCP(metadata MetadataValues, batch []LogEntry) error {
+	var b bytes.Buffer
+	for _, entry := range batch {
+		msg, err := g.message(metadata, entry)
+		if err != nil {
+			return err
+		}
+		b.Write(msg)
+		b.WriteByte(0)
+	}
+	// Some of the batch may make it before an error, in which case it'll be duplicated
+	_, err := g.conn.Write(b.Bytes())
+	return err
+}
+
+func (g *GELFOutput) sendUDP(metadata MetadataValues, batch []LogEntry) error {
+	chunkSize := g.ChunkSize
+	if chunkSize <= gelfChunkHeaderSize {
+		chunkSize = DefaultGELFChunkSize
+	}
+	var tooLarge []LogEntry
+	for _, entry := range batch {
+		msg, err := g.message(metadata, entry)
+		if err != nil {
+			return err
+		}
+		chunks, err := gelfChunks(compress(string(msg)), chunkSize)
+		if err != nil {
+			tooLarge = append(tooLarge, entry)
+			continue
+		}
+		for _, chunk := range chunks {
+			_, err = g.conn.Write(chunk)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(tooLarge) > 0 {
+		return &PartialError{
+			Rejected: tooLarge,
+			Err:      fmt.Errorf("%d of %d messages are too large for GELF over UDP", len(tooLarge), len(batch)),
+		}
+	}
+	return nil
+}
+
+func (g *GELFOutput) message(metadata MetadataValues, entry LogEntry) ([]byte, error) {
+	msg := map[string]interface{}{
+		"version":       "1.1",
+		"host":          metadata.host,
+		"short_message": entry.Message,
+		"timestamp":     json.Number(fmt.Sprintf("%d.%06d", entry.Timestamp/1e6, entry.Timestamp%1e6)),
+	}
+	if level, err := strconv.Atoi(entry.Fields["PRIORITY"]); err == nil && level >= 0 && level <= 7 {
+		msg["level"] = level
+	}
+	for _, field := range g.Fields {
+		if value, ok := entry.Fields[field]; ok {
+			msg[gelfFieldName(field)] = value
+		}
+	}
+	for name, value := range map[string]string{
+		"_category":  metadata.category,
+		"_source":    metadata.source,
+		"_namespace": metadata.namespace,
+		"_pod":       metadata.pod,
+		"_owner":     metadata.owner,
+		"_container": metadata.container,
+	} {
+		if value != "" {
+			msg[name] = value
+		}
+	}
+	return json.Marshal(msg)
+}
+
+// Additional field names are lower case, with an underscore in front, e.g _PID is _pid.
+// _id is reserved, so a journal field that would be called that is _id_ instead.
+func gelfFieldName(field string) string {
+	name := "_" + strings.ToLower(strings.TrimLeft(field, "_"))
+	if name == "_id" {
+		name = "_id_"
+	}
+	return name
+}
+
+// Splits a message into chunks of at most chunkSize, including the header, if
+// it doesn't fit in one. Graylog gives up on messages of more than 128 chunks.
+func gelfChunks(msg []byte, chunkSize int) ([][]byte, error) {
+	if len(msg) <= chunkSize {
+		return [][]byte{msg}, nil
+	}
+	dataSize := chunkSize - gelfChunkHeaderSize
+	count := (len(msg) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("message needs %d chunks, more than %d", count, gelfMaxChunks)
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	var chunks [][]byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk := append([]byte{0x1e, 0x0f}, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks = append(chunks, append(chunk, msg[i*dataSize:end]...))
+	}
+	return chunks, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var gelfTestMetadata = MetadataValues{
+	category:  "prod/kubernetes/kube-system/kube-proxy",
+	source:    "kube-system.kube-proxy-abcde",
+	host:      "node-1",
+	namespace: "kube-system",
+	pod:       "kube-proxy-abcde",
+}
+
+var gelfTestEntry = LogEntry{
+	Timestamp: 1563537600123456,
+	Message:   "hello",
+	Fields:    map[string]string{"MESSAGE": "hello", "PRIORITY": "3", "_PID": "1234", "_COMM": "kube-proxy"},
+}
+
+var gelfTestMessage = map[string]interface{}{
+	"version":       "1.1",
+	"host":          "node-1",
+	"short_message": "hello",
+	"timestamp":     1563537600.123456,
+	"level":         float64(3),
+	"_pid":          "1234",
+	"_category":     "prod/kubernetes/kube-system/kube-proxy",
+	"_source":       "kube-system.kube-proxy-abcde",
+	"_namespace":    "kube-system",
+	"_pod":          "kube-proxy-abcde",
+}
+
+// testGELFServer collects the messages sent to it, over TCP or UDP
+type testGELFServer struct {
+	mu       sync.Mutex
+	messages []map[string]interface{}
+}
+
+func (s *testGELFServer) add(t *testing.T, msg []byte) {
+	var m map[string]interface{}
+	assert.NoError(t, json.Unmarshal(msg, &m))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+}
+
+func (s *testGELFServer) Messages() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages
+}
+
+func TestGELFTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	server := &testGELFServer{}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := r.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			server.add(t, msg[:len(msg)-1])
+		}
+	}()
+
+	gelf := &GELFOutput{Addr: l.Addr().String(), Protocol: "tcp", Fields: []string{"_PID"}}
+	assert.NoError(t, gelf.Send(context.Background(), gelfTestMetadata, []LogEntry{gelfTestEntry, gelfTestEntry}))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 2
+	})
+	assert.Equal(t, gelfTestMessage, server.Messages()[0])
+}
+
+func TestGELFUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	server := &testGELFServer{}
+	go func() {
+		chunks := map[string][][]byte{}
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			datagram := append([]byte{}, buf[:n]...)
+			if datagram[0] == 0x1e && datagram[1] == 0x0f {
+				id := string(datagram[2:10])
+				if chunks[id] == nil {
+					chunks[id] = make([][]byte, datagram[11])
+				}
+				chunks[id][datagram[10]] = datagram[12:]
+				for _, chunk := range chunks[id] {
+					if chunk == nil {
+						datagram = nil
+						break
+					}
+				}
+				if datagram == nil {
+					continue
+				}
+				datagram = bytes.Join(chunks[id], nil)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(datagram))
+			assert.NoError(t, err)
+			msg, err := ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+			server.add(t, msg)
+		}
+	}()
+
+	gelf := &GELFOutput{Addr: conn.LocalAddr().String(), Protocol: "udp", Fields: []string{"_PID"}, ChunkSize: 100}
+	assert.NoError(t, gelf.Send(context.Background(), gelfTestMetadata, []LogEntry{gelfTestEntry}))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 1
+	})
+	assert.Equal(t, gelfTestMessage, server.Messages()[0])
+
+	// Too big even in 128 chunks, so it will never be delivered
+	big := gelfTestEntry
+	random := make([]byte, 20000)
+	_, err = rand.Read(random)
+	assert.NoError(t, err)
+	big.Message = hex.EncodeToString(random)
+	err = gelf.Send(context.Background(), gelfTestMetadata, []LogEntry{big, gelfTestEntry})
+	if assert.IsType(t, &PartialError{}, err) {
+		assert.Equal(t, []LogEntry{big}, err.(*PartialError).Rejected)
+		assert.Empty(t, err.(*PartialError).Retry)
+	}
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 2
+	})
+}
+
+func TestGELFChunks(t *testing.T) {
+	msg := []byte(strings.Repeat("a", 25))
+	chunks, err := gelfChunks(msg, 25)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{msg}, chunks)
+
+	chunks, err = gelfChunks(msg, 22)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 3)
+	for i, chunk := range chunks {
+		assert.Equal(t, []byte{0x1e, 0x0f}, chunk[:2])
+		assert.Equal(t, chunks[0][2:10], chunk[2:10])
+		assert.Equal(t, []byte{byte(i), 3}, chunk[10:12])
+	}
+	assert.Len(t, chunks[0], 22)
+	assert.Len(t, chunks[2], 17)
+
+	_, err = gelfChunks(make([]byte, 129), 13)
+	assert.Error(t, err)
+}
+
+func TestGELFFieldName(t *testing.T) {
+	assert.Equal(t, "_pid", gelfFieldName("_PID"))
+	assert.Equal(t, "_syslog_identifier", gelfFieldName("SYSLOG_IDENTIFIER"))
+	assert.Equal(t, "_id_", gelfFieldName("ID"))
+}
+
+func TestGELFCancelled(t *testing.T) {
+	l := newStuckPeer(t)
+	defer l.Close()
+	assertSendCancels(t, &GELFOutput{Protocol: "tcp", Addr: l.Addr().String()})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Health collects problems that won't go away without someone fixing the
+// configuration, such as a collector rejecting our credentials. /healthz fails
+// while there are any, so they show up as an unready pod rather than only in logs.
+type Health struct {
+	mu       sync.Mutex
+	problems map[string]string
+}
+
+var health = &Health{}
+
+// Records a problem with component, replacing any it already had
+func (h *Health) Fail(component string, problem string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.problems == nil {
+		h.problems = map[string]string{}
+	}
+	h.problems[component] = problem
+}
+
+func (h *Health) Recover(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.problems, component)
+}
+
+// Returns a line per problem, sorted by component
+func (h *Health) Problems() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var problems []string
+	for component, problem := range h.problems {
+		problems = append(problems, component+": "+problem)
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	problems := h.Problems()
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// Serves /healthz on addr
+func (h *Health) Start(addr string) {
+	//listen up front so a bad address fails at startup rather than in the background
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	go func() {
+		log.Fatal(http.Serve(listener, mux))
+	}()
+	log.Println("health checks available at: ", addr)
+}
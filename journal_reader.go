@@ -12,18 +12,50 @@ import (
 // Block for up to this long waiting for a journal entry
 const JournalWaitTime = time.Duration(2) * time.Second
 
+// Journal is the subset of *sdjournal.Journal that we use, so tests can substitute a fake
+type Journal interface {
+	Next() (uint64, error)
+	Wait(timeout time.Duration) int
+	GetEntry() (*sdjournal.JournalEntry, error)
+	SeekCursor(cursor string) error
+	SetDataThreshold(threshold uint64) error
+	AddMatch(match string) error
+	AddDisjunction() error
+	Close() error
+}
+
 type JournalReader struct {
 	StateFilePath string
-	Cursor        string
-	Journal       *sdjournal.Journal
+	Cursor        string // cursor of the last entry read, not necessarily delivered
+	Journal       Journal
+
+	// Opens the underlying journal, defaults to sdjournal.NewJournal
+	NewJournal func() (Journal, error)
+
+	// If set, only entries satisfying any of these are read, see FilterChain.PushDown
+	Matches []JournalMatch
+
+	savedCursor string
 }
 
 func (jr *JournalReader) Open(stateFilePath string) {
 	jr.StateFilePath = stateFilePath
 	jr.Cursor = jr.readStateFile()
+	jr.savedCursor = jr.Cursor
 	jr.openJournal()
 }
 
+// Persists cursor to the state file, which is where we resume from after a restart.
+// Only pass cursors for which every entry up to and including it has been delivered.
+// Doesn't touch the journal, so it can be called while another goroutine is reading.
+func (jr *JournalReader) SaveCursor(cursor string) {
+	if cursor == "" || cursor == jr.savedCursor {
+		return
+	}
+	jr.writeStateFile(cursor)
+	jr.savedCursor = cursor
+}
+
 func (jr *JournalReader) GetNextEntry() *sdjournal.JournalEntry {
 	// Look for a new Journal entry
 	r, err := jr.Journal.Next()
@@ -69,8 +101,12 @@ func (jr *JournalReader) GetNextEntry() *sdjournal.JournalEntry {
 		}
 	}
 
+	if ent.Cursor == jr.Cursor {
+		// After seeking, the journal hands us back the entry at the cursor we
+		// sought to. We've already had that one.
+		return nil
+	}
 	jr.Cursor = ent.Cursor
-	jr.writeStateFile()
 	return ent
 }
 
@@ -87,7 +123,12 @@ func (jr *JournalReader) openJournal() {
 		jr.Journal = nil
 	}
 
-	j, err := sdjournal.NewJournal()
+	if jr.NewJournal == nil {
+		jr.NewJournal = func() (Journal, error) {
+			return sdjournal.NewJournal()
+		}
+	}
+	j, err := jr.NewJournal()
 	if err != nil {
 		log.Fatalln("Could not open journal:", err)
 	}
@@ -99,6 +140,21 @@ func (jr *JournalReader) openJournal() {
 		log.Fatalln("Could not set journal data threshold:", err)
 	}
 
+	for i, match := range jr.Matches {
+		if i > 0 {
+			err = jr.Journal.AddDisjunction()
+			if err != nil {
+				log.Fatalln("Could not add journal disjunction:", err)
+			}
+		}
+		for _, term := range match {
+			err = jr.Journal.AddMatch(term)
+			if err != nil {
+				log.Fatalln("Could not add journal match:", term, err)
+			}
+		}
+	}
+
 	if jr.Cursor == "" {
 		log.Println("No last cursor, starting from beginning")
 	} else {
@@ -124,8 +180,13 @@ func (jr *JournalReader) readStateFile() string {
 	return string(b)
 }
 
-func (jr *JournalReader) writeStateFile() {
-	err := ioutil.WriteFile(jr.StateFilePath, []byte(jr.Cursor), os.FileMode(0600))
+func (jr *JournalReader) writeStateFile(cursor string) {
+	// Write then rename so a crash mid-write can't leave us with a truncated cursor
+	tmpPath := jr.StateFilePath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, []byte(cursor), os.FileMode(0600))
+	if err == nil {
+		err = os.Rename(tmpPath, jr.StateFilePath)
+	}
 	if err != nil {
 		log.Fatalln("Failed to write state file:", err)
 	}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeJournal is an in-memory stand in for sdjournal with the same cursor semantics:
+// after SeekCursor, Next lands on the entry at that cursor. Matches work as they do
+// in sd_journal_add_match(3).
+type fakeJournal struct {
+	entries []*sdjournal.JournalEntry
+	pos     int
+	matches []JournalMatch
+	parsed  []map[string][]string // matches split by field, as the journal would index them
+
+	// Number of entries handed out by GetEntry
+	gets int
+}
+
+func newFakeJournal(n int) *fakeJournal {
+	j := &fakeJournal{pos: -1}
+	for i := 1; i <= n; i++ {
+		j.entries = append(j.entries, &sdjournal.JournalEntry{
+			Fields: map[string]string{
+				"MESSAGE":           fmt.Sprintf("message %d", i),
+				"SYSLOG_IDENTIFIER": "test",
+				"_TRANSPORT":        "journal",
+			},
+			Cursor:            fmt.Sprintf("s=test;i=%d", i),
+			RealtimeTimestamp: uint64(1527115596680939 + i),
+		})
+	}
+	return j
+}
+
+func (j *fakeJournal) Next() (uint64, error) {
+	for j.pos+1 < len(j.entries) {
+		j.pos++
+		if j.isMatch(j.entries[j.pos]) {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (j *fakeJournal) isMatch(e *sdjournal.JournalEntry) bool {
+	if len(j.matches) == 0 {
+		return true
+	}
+	if j.parsed == nil {
+		for _, m := range j.matches {
+			j.parsed = append(j.parsed, splitJournalMatch(m))
+		}
+	}
+NextMatch:
+	for _, m := range j.parsed {
+		for field, values := range m {
+			if !ListContains(values, e.Fields[field]) {
+				continue NextMatch
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (j *fakeJournal) AddMatch(match string) error {
+	if len(j.matches) == 0 {
+		j.matches = []JournalMatch{{}}
+	}
+	last := len(j.matches) - 1
+	j.matches[last] = append(j.matches[last], match)
+	j.parsed = nil
+	return nil
+}
+
+func (j *fakeJournal) AddDisjunction() error {
+	j.matches = append(j.matches, JournalMatch{})
+	j.parsed = nil
+	return nil
+}
+
+func (j *fakeJournal) Wait(timeout time.Duration) int {
+	return sdjournal.SD_JOURNAL_NOP
+}
+
+func (j *fakeJournal) GetEntry() (*sdjournal.JournalEntry, error) {
+	// Like sdjournal, every entry is a fresh copy of all its fields
+	j.gets++
+	e := j.entries[j.pos]
+	fields := make(map[string]string, len(e.Fields))
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	return &sdjournal.JournalEntry{
+		Fields:             fields,
+		Cursor:             e.Cursor,
+		RealtimeTimestamp:  e.RealtimeTimestamp,
+		MonotonicTimestamp: e.MonotonicTimestamp,
+	}, nil
+}
+
+func (j *fakeJournal) SeekCursor(cursor string) error {
+	for i, e := range j.entries {
+		if e.Cursor == cursor {
+			j.pos = i - 1
+			return nil
+		}
+	}
+	return fmt.Errorf("no such cursor: %s", cursor)
+}
+
+func (j *fakeJournal) SetDataThreshold(threshold uint64) error {
+	return nil
+}
+
+func (j *fakeJournal) Close() error {
+	return nil
+}
+
+func openFakeJournal(t *testing.T, j *fakeJournal, stateFilePath string) *JournalReader {
+	jr := &JournalReader{
+		NewJournal: func() (Journal, error) {
+			// Each open gets its own read position, like a fresh process would
+			return &fakeJournal{entries: j.entries, pos: -1}, nil
+		},
+	}
+	jr.Open(stateFilePath)
+	return jr
+}
+
+// Reads every entry from a fake journal, returns the messages of those chain wants
+func readAllWanted(jr *JournalReader, chain *FilterChain) []string {
+	var messages []string
+	fj := jr.Journal.(*fakeJournal)
+	for fj.pos+1 < len(fj.entries) {
+		ent := jr.GetNextEntry()
+		if ent != nil && chain.Want(ent) {
+			messages = append(messages, ent.Fields["MESSAGE"])
+		}
+	}
+	return messages
+}
+
+// Builds a journal where one in ten entries is from the journal transport and the
+// rest are kernel messages
+func newMixedFakeJournal(n int) *fakeJournal {
+	j := newFakeJournal(n)
+	for i, e := range j.entries {
+		if i%10 != 0 {
+			e.Fields["_TRANSPORT"] = "kernel"
+		}
+	}
+	return j
+}
+
+func TestJournalReaderResumesAfterCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFilePath := filepath.Join(dir, DefaultStateFile)
+
+	j := newFakeJournal(3)
+	jr := openFakeJournal(t, j, stateFilePath)
+	assert.Equal(t, "message 1", jr.GetNextEntry().Fields["MESSAGE"])
+	jr.SaveCursor(jr.Cursor)
+
+	// Reading on doesn't move the state file unless we say so
+	assert.Equal(t, "message 2", jr.GetNextEntry().Fields["MESSAGE"])
+
+	jr = openFakeJournal(t, j, stateFilePath)
+	assert.Equal(t, "s=test;i=1", jr.Cursor)
+	assert.Nil(t, jr.GetNextEntry(), "entry at saved cursor should not be returned again")
+	assert.Equal(t, "message 2", jr.GetNextEntry().Fields["MESSAGE"])
+}
+
+func TestCrashRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFilePath := filepath.Join(dir, DefaultStateFile)
+
+	collector := newTestCollector(200)
+	defer collector.Close()
+	sumo := newTestSumoUploader(collector.URL)
+
+	// Messages 3 and 5 go in a buffer of their own
+	j := newFakeJournal(6)
+	j.entries[2].Fields["_TRANSPORT"] = "kernel"
+	j.entries[4].Fields["_TRANSPORT"] = "kernel"
+	rawMessages := &FilterChain{}
+	rawMessages.AddFilter(func(e *sdjournal.JournalEntry) bool {
+		return false
+	})
+	start := func() *Pipeline {
+		// Whatever was buffered is lost
+		activeBuffers.Flush()
+		seenCursors.Flush()
+		spool, err := OpenSpool(filepath.Join(dir, DefaultSpoolDir), 1024*1024, []string{sumo.Name()}, sumo.Metrics)
+		assert.NoError(t, err)
+		jr := openFakeJournal(t, j, stateFilePath)
+		return &Pipeline{
+			Reader:               jr,
+			Checkpoint:           NewCheckpoint(jr.Cursor),
+			Spool:                spool,
+			Metrics:              sumo.Metrics,
+			EventFilters:         &FilterChain{},
+			FormatMessageFilters: rawMessages,
+			Outputs:              []Output{sumo},
+		}
+	}
+	read := func(p *Pipeline, messages ...string) {
+		for _, message := range messages {
+			ent := p.Reader.GetNextEntry()
+			if assert.NotNil(t, ent) {
+				assert.Equal(t, message, ent.Fields["MESSAGE"])
+				p.handleEntry(ent)
+			}
+		}
+	}
+	flush := func(p *Pipeline, message string) {
+		ent := j.entries[0]
+		for _, e := range j.entries {
+			if e.Fields["MESSAGE"] == message {
+				ent = e
+			}
+		}
+		getOrCreateActiveBufferForEntry(ent).Age = time.Now().Add(-MaxBufferAge - time.Second)
+		p.flushBuffers()
+	}
+
+	// Nothing is delivered before the crash, it's all left in the spool
+	p := start()
+	read(p, "message 1", "message 2")
+	flush(p, "message 1")
+	read(p, "message 3", "message 4", "message 5")
+	flush(p, "message 3")
+
+	// Crash with message 4 still sitting in a buffer: the state file must not have moved past it
+	state, err := ioutil.ReadFile(stateFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "s=test;i=3", string(state))
+	assert.Empty(t, collector.Lines())
+
+	// Restart with empty buffers, what was spooled is sent and the rest is read again
+	p = start()
+	defer p.Spool.Close()
+	go p.Spool.Drain(sumo.Name(), NewOutputWorker(sumo, sumo.Metrics).Deliver)
+	assert.Nil(t, p.Reader.GetNextEntry()) // message 3 again, skipped
+	read(p, "message 4", "message 5", "message 6")
+	flush(p, "message 4")
+	flush(p, "message 5")
+	assert.Equal(t, 0, p.Shutdown(time.Now().Add(5*time.Second)))
+
+	// Everything arrives at least once, anything not spooled at the crash is resent
+	assert.Equal(t, []string{
+		"message 1", "message 2",
+		"message 3", "message 5",
+		"message 4", "message 6",
+		"message 5",
+	}, collector.Lines())
+
+	state, err = ioutil.ReadFile(stateFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "s=test;i=6", string(state))
+}
+
+func TestJournalReaderMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	chain := &FilterChain{}
+	chain.AddMatchFilter(FilterByTransport([]string{"journal"}), TransportMatches([]string{"journal"}), true)
+	chain.AddFilter(ExcludeBySystemDUnit([]string{"test.service"}))
+
+	j := newMixedFakeJournal(30)
+	jr := openFakeJournal(t, j, filepath.Join(dir, DefaultStateFile))
+	inProcess := readAllWanted(jr, chain)
+	assert.Equal(t, 30, jr.Journal.(*fakeJournal).gets)
+
+	matches, rest := chain.PushDown()
+	jr = &JournalReader{Matches: matches, NewJournal: func() (Journal, error) {
+		return &fakeJournal{entries: j.entries, pos: -1}, nil
+	}}
+	jr.Open(filepath.Join(dir, DefaultStateFile))
+	pushedDown := readAllWanted(jr, rest)
+
+	// Same result, only the wanted entries were deserialized
+	assert.Equal(t, []string{"message 1", "message 11", "message 21"}, pushedDown)
+	assert.Equal(t, inProcess, pushedDown)
+	assert.Equal(t, 3, jr.Journal.(*fakeJournal).gets)
+}
+
+// Reads a mixed journal keeping only journal transport entries, either by filtering
+// in process or with the filter pushed down as a journal match. The fake journal's
+// GetEntry copies every field of every entry it hands out, as sdjournal does, so the
+// saving comes from the nine in ten entries that pushed down matches never copy.
+func benchmarkFilter(b *testing.B, pushDown bool) {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chain := &FilterChain{}
+	chain.AddMatchFilter(FilterByTransport([]string{"journal"}), TransportMatches([]string{"journal"}), true)
+	var matches []JournalMatch
+	if pushDown {
+		matches, chain = chain.PushDown()
+	}
+
+	j := newMixedFakeJournal(10000)
+	for _, e := range j.entries {
+		// The fields a typical entry has, to copy
+		for _, field := range []string{"_BOOT_ID", "_MACHINE_ID", "_HOSTNAME", "_PID", "_UID", "_GID", "_COMM", "_EXE", "_CMDLINE", "_CAP_EFFECTIVE", "_SYSTEMD_CGROUP", "_SYSTEMD_UNIT", "_SYSTEMD_SLICE", "PRIORITY", "SYSLOG_FACILITY"} {
+			e.Fields[field] = strings.Repeat("x", 32)
+		}
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	gets := 0
+	for i := 0; i < b.N; i++ {
+		jr := &JournalReader{Matches: matches, NewJournal: func() (Journal, error) {
+			return &fakeJournal{entries: j.entries, pos: -1}, nil
+		}}
+		jr.Open(filepath.Join(dir, DefaultStateFile))
+		readAllWanted(jr, chain)
+		gets += jr.Journal.(*fakeJournal).gets
+	}
+	b.StopTimer()
+	b.Logf("%d entries copied by GetEntry per read of %d", gets/b.N, len(j.entries))
+}
+
+func BenchmarkFilterInProcess(b *testing.B) {
+	benchmarkFilter(b, false)
+}
+
+func BenchmarkFilterPushedDown(b *testing.B) {
+	benchmarkFilter(b, true)
+}
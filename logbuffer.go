@@ -11,32 +11,35 @@ const (
 )
 
 type LogBuffer struct {
-	Messages   []string
+	Entries    []LogEntry
 	TotalBytes int
 	Age        time.Time
 	Metadata   MetadataValues
+	Seq        uint64    // checkpoint sequence of the oldest message, see Checkpoint
+	Created    time.Time // its metadata is looked up again once it is old enough, see Pipeline.flushBuffers
 }
 
-func (buf *LogBuffer) Append(msg string) {
-	if len(buf.Messages) == 0 {
+func (buf *LogBuffer) Append(entry LogEntry) {
+	if len(buf.Entries) == 0 {
 		buf.Age = time.Now()
 	}
-	buf.Messages = append(buf.Messages, msg)
-	buf.TotalBytes += len(msg)
+	buf.Entries = append(buf.Entries, entry)
+	buf.TotalBytes += len(entry.Message)
 }
 
 func (buf *LogBuffer) Clear() {
-	buf.Messages = []string{}
+	buf.Entries = []LogEntry{}
 	buf.TotalBytes = 0
 	buf.Age = time.Time{}
+	buf.Seq = 0
 }
 
 func (buf *LogBuffer) NeedsFlush() bool {
 	bufferAge := time.Since(buf.Age)
-	r := len(buf.Messages) > 0 && (buf.TotalBytes > MaxBufferBytes || bufferAge > MaxBufferAge)
+	r := len(buf.Entries) > 0 && (buf.TotalBytes > MaxBufferBytes || bufferAge > MaxBufferAge)
 	return r
 }
 
-func (buf *LogBuffer) GetMessages() []string {
-	return buf.Messages
+func (buf *LogBuffer) GetEntries() []LogEntry {
+	return buf.Entries
 }
@@ -7,9 +7,9 @@ import (
 
 func TestLogBuffer(t *testing.T) {
 	b := LogBuffer{}
-	b.Append("my dog has fleas")
+	b.Append(LogEntry{Message: "my dog has fleas"})
 	assert.Equal(t, b.TotalBytes, 16)
-	assert.Equal(t, len(b.Messages), 1)
+	assert.Equal(t, len(b.Entries), 1)
 	assert.False(t, b.NeedsFlush())
 	// TODO: test age, probably need clockwork to mock time
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Loki takes entries up to this much older than a stream's newest by default, half
+// its max_chunk_age. A stream that hasn't been pushed to for longer than this is
+// forgotten, whatever comes next for it is newer than Loki would still reject.
+const LokiStreamExpiry = time.Hour
+
+// LokiOutput pushes entries to Grafana Loki.
+// See: https://grafana.com/docs/loki/latest/api/#post-lokiapiv1push
+//
+// A batch is always from a single buffer, so it is a single Loki stream. Loki
+// rejects lines that are older than the last one it has for a stream, so entries
+// are sorted by timestamp, batches are delivered one at a time in spool order, and
+// an entry that is still older than the last one pushed to its stream (the clock
+// went backwards, or buffers were flushed out of order) is sent with the last
+// timestamp instead of being rejected. Streams idle for LokiStreamExpiry are forgotten.
+type LokiOutput struct {
+	httpClient *http.Client
+	URL        string // e.g http://loki:3100
+	TenantID   string // sent as X-Scope-OrgID, for multi-tenant Loki
+	Username   string
+	Password   string
+
+	mu     sync.Mutex
+	latest map[string]lokiLatest // stream labels -> newest pushed
+	now    func() time.Time
+}
+
+type lokiLatest struct {
+	timestamp uint64 // in nanoseconds
+	pushed    time.Time
+}
+
+type lokiPush struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // [timestamp in nanoseconds, line]
+}
+
+func (loki *LokiOutput) Name() string {
+	return "loki"
+}
+
+// Batches have to arrive in the order they were spooled, see OrderedOutput
+func (loki *LokiOutput) Ordered() bool {
+	return true
+}
+
+func (loki *LokiOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	labels := lokiLabels(metadata)
+	key := lokiStreamKey(labels)
+
+	sorted := make([]LogEntry, len(batch))
+	copy(sorted, batch)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	loki.mu.Lock()
+	latest := loki.latest[key].timestamp
+	loki.mu.Unlock()
+
+	stream := lokiStream{Stream: labels}
+	for _, entry := range sorted {
+		ts := entry.Timestamp * 1000
+		if ts < latest {
+			ts = latest
+		}
+		latest = ts
+		stream.Values = append(stream.Values, [2]string{strconv.FormatUint(ts, 10), entry.Message})
+	}
+
+	body, err := json.Marshal(lokiPush{Streams: []lokiStream{stream}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(loki.URL, "/")+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if loki.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", loki.TenantID)
+	}
+	if loki.Username != "" {
+		req.SetBasicAuth(loki.Username, loki.Password)
+	}
+
+	resp, err := loki.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading loki response: %s", err)
+	}
+	err = HTTPResponseError(resp, respBody)
+	if err != nil {
+		return err
+	}
+
+	loki.mu.Lock()
+	defer loki.mu.Unlock()
+	if loki.latest == nil {
+		loki.latest = map[string]lokiLatest{}
+	}
+	now := loki.time()
+	for k, l := range loki.latest {
+		if now.Sub(l.pushed) > LokiStreamExpiry {
+			delete(loki.latest, k)
+		}
+	}
+	if latest < loki.latest[key].timestamp {
+		latest = loki.latest[key].timestamp
+	}
+	loki.latest[key] = lokiLatest{timestamp: latest, pushed: now}
+	return nil
+}
+
+func (loki *LokiOutput) time() time.Time {
+	if loki.now != nil {
+		return loki.now()
+	}
+	return time.Now()
+}
+
+// Kubernetes categories look like <default category>/kubernetes/<namespace>/<owner>,
+// those are split into namespace and owner labels. Anything else keeps its category.
+func lokiLabels(metadata MetadataValues) map[string]string {
+	labels := map[string]string{
+		"host":   metadata.host,
+		"source": metadata.source,
+	}
+	parts := strings.SplitN(metadata.category, "/kubernetes/", 2)
+	if len(parts) == 2 {
+		namespaceOwner := strings.SplitN(parts[1], "/", 2)
+		labels["namespace"] = namespaceOwner[0]
+		if len(namespaceOwner) == 2 {
+			labels["owner"] = namespaceOwner[1]
+		}
+	} else {
+		labels["category"] = metadata.category
+	}
+	return labels
+}
+
+// Loki's own way of writing a label set, e.g: {host="a", source="b"}
+func lokiStreamKey(labels map[string]string) string {
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
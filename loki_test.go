@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLoki records pushes, responding with status
+type testLoki struct {
+	*httptest.Server
+	mu      sync.Mutex
+	status  int
+	pushes  []lokiPush
+	tenants []string
+}
+
+func newTestLoki(status int) *testLoki {
+	l := &testLoki{status: status}
+	l.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if r.URL.Path != "/loki/api/v1/push" {
+			w.WriteHeader(404)
+			return
+		}
+		if l.status == 204 {
+			var push lokiPush
+			_ = json.NewDecoder(r.Body).Decode(&push)
+			l.pushes = append(l.pushes, push)
+			l.tenants = append(l.tenants, r.Header.Get("X-Scope-OrgID"))
+		}
+		w.WriteHeader(l.status)
+	}))
+	return l
+}
+
+// Entries with the given timestamps in microseconds, with messages "a", "b", ...
+func lokiEntries(timestamps ...uint64) []LogEntry {
+	var entries []LogEntry
+	for i, ts := range timestamps {
+		entries = append(entries, LogEntry{Timestamp: ts, Message: string('a' + rune(i))})
+	}
+	return entries
+}
+
+func TestLokiPush(t *testing.T) {
+	server := newTestLoki(204)
+	defer server.Close()
+	loki := &LokiOutput{httpClient: &http.Client{}, URL: server.URL + "/", TenantID: "tenant"}
+
+	metadata := MetadataValues{
+		category:  "prod/kubernetes/kube-system/kube-proxy",
+		source:    "kube-system.kube-proxy-abcde",
+		host:      "node-1",
+		namespace: "kube-system",
+	}
+	// The journal isn't strictly in time order
+	assert.NoError(t, loki.Send(context.Background(), metadata, lokiEntries(3, 1, 2)))
+
+	assert.Equal(t, []string{"tenant"}, server.tenants)
+	assert.Equal(t, []lokiPush{{Streams: []lokiStream{{
+		Stream: map[string]string{
+			"host":      "node-1",
+			"namespace": "kube-system",
+			"owner":     "kube-proxy",
+			"source":    "kube-system.kube-proxy-abcde",
+		},
+		Values: [][2]string{{"1000", "b"}, {"2000", "c"}, {"3000", "a"}},
+	}}}}, server.pushes)
+}
+
+func TestLokiKeepsStreamsInOrder(t *testing.T) {
+	server := newTestLoki(204)
+	defer server.Close()
+	loki := &LokiOutput{httpClient: &http.Client{}, URL: server.URL}
+	systemd := MetadataValues{category: "prod/systemd/kubelet", source: "kubelet", host: "node-1"}
+	docker := MetadataValues{category: "prod/docker/nginx", source: "nginx", host: "node-1"}
+
+	assert.NoError(t, loki.Send(context.Background(), systemd, lokiEntries(5, 6)))
+	// Other streams aren't affected
+	assert.NoError(t, loki.Send(context.Background(), docker, lokiEntries(1)))
+	// but anything older than what the stream already has is moved up to it
+	assert.NoError(t, loki.Send(context.Background(), systemd, lokiEntries(4, 7)))
+
+	assert.Len(t, server.pushes, 3)
+	assert.Equal(t, map[string]string{"host": "node-1", "source": "kubelet", "category": "prod/systemd/kubelet"}, server.pushes[0].Streams[0].Stream)
+	assert.Equal(t, [][2]string{{"5000", "a"}, {"6000", "b"}}, server.pushes[0].Streams[0].Values)
+	assert.Equal(t, [][2]string{{"1000", "a"}}, server.pushes[1].Streams[0].Values)
+	assert.Equal(t, [][2]string{{"6000", "a"}, {"7000", "b"}}, server.pushes[2].Streams[0].Values)
+}
+
+func TestLokiForgetsIdleStreams(t *testing.T) {
+	server := newTestLoki(204)
+	defer server.Close()
+	now := time.Date(2019, 7, 20, 0, 0, 0, 0, time.UTC)
+	loki := &LokiOutput{httpClient: &http.Client{}, URL: server.URL, now: func() time.Time { return now }}
+	systemd := MetadataValues{category: "prod/systemd/kubelet", source: "kubelet", host: "node-1"}
+	docker := MetadataValues{category: "prod/docker/nginx", source: "nginx", host: "node-1"}
+
+	assert.NoError(t, loki.Send(context.Background(), systemd, lokiEntries(5)))
+	now = now.Add(LokiStreamExpiry)
+	assert.NoError(t, loki.Send(context.Background(), docker, lokiEntries(1)))
+	assert.Len(t, loki.latest, 2)
+
+	// Only the stream that has been pushed to since is kept
+	now = now.Add(time.Second)
+	assert.NoError(t, loki.Send(context.Background(), docker, lokiEntries(2)))
+	assert.Len(t, loki.latest, 1)
+	assert.NoError(t, loki.Send(context.Background(), systemd, lokiEntries(4)))
+	assert.Len(t, loki.latest, 2)
+	assert.Equal(t, [][2]string{{"4000", "a"}}, server.pushes[3].Streams[0].Values)
+}
+
+func TestLokiErrors(t *testing.T) {
+	server := newTestLoki(400)
+	defer server.Close()
+	loki := &LokiOutput{httpClient: &http.Client{}, URL: server.URL}
+	err := loki.Send(context.Background(), MetadataValues{}, lokiEntries(1))
+	assert.IsType(t, &RejectedError{}, err)
+
+	server.status = 429
+	err = loki.Send(context.Background(), MetadataValues{}, lokiEntries(1))
+	assert.IsType(t, &ThrottledError{}, err)
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/coreos/go-systemd/sdjournal"
 	"github.com/patrickmn/go-cache"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -15,18 +14,29 @@ import (
 )
 
 const (
-	DefaultStateFile = "log-forwarder.state"
+	DefaultStateFile     = "log-forwarder.state"
+	DefaultSpoolDir      = "spool"
+	DefaultSpoolSizeMB   = 512
+	DefaultDeadLetterDir = "deadletter"
 )
 
 var stateFile = flag.String("statefile", DefaultStateFile, "File to checkpoint log position for resuming.")
 var metricsArg = flag.String("metrics", "none", "metrics provider (none,datadog,prometheus)")
+var spoolDir = flag.String("spooldir", DefaultSpoolDir, "Directory to spool flushed buffers to until they are uploaded.")
+var spoolSize = flag.Int64("spoolsize", DefaultSpoolSizeMB, "Maximum size of the spool in megabytes, the oldest buffers are dropped beyond this.")
+var uploadWorkers = flag.Int("uploadworkers", DefaultUploadWorkers, "Number of concurrent uploads per output.")
+var uploadTimeout = flag.Duration("uploadtimeout", DefaultUploadTimeout, "Time limit on each attempt at an upload.")
+var deadLetterDir = flag.String("deadletterdir", DefaultDeadLetterDir, "Directory to keep batches an output rejected outright, empty to drop them.")
+var healthAddr = flag.String("healthaddr", "", "Address to serve /healthz on, e.g :9181. Disabled if empty.")
+var shutdownTimeout = flag.Duration("shutdowntimeout", DefaultShutdownTimeout, "How long to spend delivering buffered logs on shutdown.")
 
 const activeBufferExpiry = 24*time.Hour
 const seenCursorExpiry = 10*time.Minute
 
 
-//Maintain an expiring map of queues, will look up by queue identifier, inactive queues will be collected by the map
-var activeBuffers = cache.New(activeBufferExpiry, activeBufferExpiry)
+//Maintain a map of queues, will look up by queue identifier. The buffer manager drops queues once they're empty
+//and older than activeBufferExpiry (see Pipeline.flushBuffers), the map mustn't expire them as they may hold entries
+var activeBuffers = cache.New(cache.NoExpiration, 0)
 
 //This is for debugging; lets us know if for we're reprocessing log messages for whatever reason.
 var seenCursors = cache.New(seenCursorExpiry, seenCursorExpiry)
@@ -37,23 +47,41 @@ func main() {
 	metrics := &Metrics{}
 	metrics.Init()
 
-	sumoUploader := &SumoUploader{
-		httpClient:                     &http.Client{},
-		Metrics:                        metrics,
-		TrustedTimestampCollectorUrl:   MustGetEnv("SUMO_TRUSTED_TIMESTAMP_COLLECTOR_URL", "SUMO_COLLECTOR_URL"),
-		UntrustedTimestampCollectorUrl: MustGetEnv("SUMO_UNTRUSTED_TIMESTAMP_COLLECTOR_URL", "SUMO_COLLECTOR_URL"),
+	outputNames := Split(os.Getenv("OUTPUTS"), ",")
+	if len(outputNames) == 0 {
+		outputNames = []string{"sumo"}
 	}
+	var outputs []Output
+	for _, name := range outputNames {
+		outputs = append(outputs, MakeOutput(name, metrics))
+	}
+	log.Println("Sending logs to outputs: ", outputNames)
 
 	//setup metadata defaults
 	SetMetadataDefaults(MetadataValues{
-		MustGetEnv("SUMO_SOURCE_NAME"),
-		MustGetEnv("SUMO_SOURCE_CATEGORY"),
-		GetHostname(os.Getenv("SUMO_SOURCE_HOST")),
-		true,
+		source:           MustGetEnv("SUMO_SOURCE_NAME"),
+		category:         MustGetEnv("SUMO_SOURCE_CATEGORY"),
+		host:             GetHostname(os.Getenv("SUMO_SOURCE_HOST")),
+		trustedTimestamp: true,
 	})
 
-	jr := &JournalReader{}
-	jr.Open(*stateFile)
+	spool, err := OpenSpool(*spoolDir, *spoolSize*1024*1024, outputNames, metrics)
+	if err != nil {
+		log.Fatalln("Error opening spool: ", err)
+	}
+	//every output drains the spool on its own, so a slow one doesn't hold up the rest
+	for _, output := range outputs {
+		workers := *uploadWorkers
+		if o, ok := output.(OrderedOutput); ok && o.Ordered() {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			worker := NewOutputWorker(output, metrics)
+			worker.DeadLetterDir = *deadLetterDir
+			worker.Timeout = *uploadTimeout
+			go spool.Drain(output.Name(), worker.Deliver)
+		}
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -64,7 +92,7 @@ func main() {
 		Split(os.Getenv("JOURNAL_EXCLUDE_TRANSPORTS"), ","),
 	)
 	log.Println("Listening for journald transports: ", allowedEventTransports)
-	eventFilters.AddFilter(FilterByTransport(allowedEventTransports))
+	eventFilters.AddMatchFilter(FilterByTransport(allowedEventTransports), TransportMatches(allowedEventTransports), true)
 
 	formatMessageFilters := &FilterChain{}
 	excludeFormatMessageUnits := Split(os.Getenv("FORMAT_MESSAGE_EXCLUDE_UNITS"), ",")
@@ -81,97 +109,91 @@ func main() {
 		log.Println("Excluding systemd units named: ", excludeUnits)
 	}
 
-	excludeSumoCategories := Split(os.Getenv("SUMO_EXCLUDE_SOURCE_CATEGORIES"), ",")
-	if len(excludeSumoCategories) > 0 {
-		log.Println("Excluding messages for sumo source categories: ", excludeSumoCategories)
+	filterRulesFile := os.Getenv("FILTER_RULES_FILE")
+	if filterRulesFile != "" {
+		rules, err := LoadFilterRules(filterRulesFile)
+		if err != nil {
+			log.Fatalln("Error loading filter rules: ", err)
+		}
+		//rules can match on the metadata the entry would be sent with, which is what its buffer has
+		rulesFilter, err := rules.Compile(func(e *sdjournal.JournalEntry) MetadataValues {
+			return getOrCreateActiveBufferForEntry(e).Metadata
+		})
+		if err != nil {
+			log.Fatalln("Error in filter rules: ", filterRulesFile, err)
+		}
+		rulesMatches, exact := rules.JournalMatches()
+		eventFilters.AddMatchFilter(rulesFilter, rulesMatches, exact)
+		log.Println("Filtering with rules from: ", filterRulesFile)
 	}
 
-	metrics.Start(*metricsArg)
-	var mainLoopLast time.Time
-	var lastCursor string
-
-MainLoop:
-	for {
-		metrics.MainLoopSpins.Inc(1)
-		if !mainLoopLast.IsZero() {
-			metrics.MainLoopTime.UpdateSince(mainLoopLast)
+	var routes RouteFn
+	routingRulesFile := os.Getenv("ROUTING_RULES_FILE")
+	if routingRulesFile != "" {
+		rules, err := LoadRoutingRules(routingRulesFile)
+		if err != nil {
+			log.Fatalln("Error loading routing rules: ", err)
 		}
-		mainLoopLast = time.Now()
-
-		// Non-blocking check for SIGINT or SIGTERM
-		select {
-		case _ = <-sigCh:
-			break MainLoop
-		default:
+		routes, err = rules.Compile(func(e *sdjournal.JournalEntry) MetadataValues {
+			return getOrCreateActiveBufferForEntry(e).Metadata
+		}, outputs)
+		if err != nil {
+			log.Fatalln("Error in routing rules: ", routingRulesFile, err)
 		}
+		log.Println("Routing with rules from: ", routingRulesFile)
+	}
 
-		ent := jr.GetNextEntry()
-		if ent != nil {
-			if ent.Cursor == lastCursor {
-				// Hrm, same cursor? Ok, skip it
-				metrics.DebugSkippedCursor.Inc(1)
-			} else if eventFilters.Want(ent) {
-				//by default just use the raw message
-				logMessage := ent.Fields["MESSAGE"]
-
-				//optionally, if the transport is configured to be formatted then use a formatted message instead
-				if formatMessageFilters.Want(ent) {
-					logMessage = FormatLogEntry(ent)
-				}
-
-				//lookup correct buffer for entry
-				buf := getOrCreateActiveBufferForEntry(ent)
-
-				//check whether category is excluded
-				if !isSumoCategoryExcluded(buf.Metadata.category, excludeSumoCategories) {
-					//append desired msg to that queue
-					buf.Append(logMessage)
-					err := seenCursors.Add(ent.Cursor, nil, seenCursorExpiry)
-					if err != nil {
-						// Shouldn't happen!
-						log.Println("Error: processing previously seen cursor: ", ent.Cursor)
-						metrics.DebugDupCursor.Inc(1)
-					}
-				}
-			}
-			lastCursor = ent.Cursor
-		}
+	//let the journal do as much of the filtering as it can, it's far cheaper than
+	//deserializing every entry only to throw most of them away
+	journalMatches, eventFilters := eventFilters.PushDown()
+	log.Println("Journal matches: ", journalMatches)
 
-		//loop through buffers, start goroutine to check flush, do upload if required and then clear buffer.
-		activeBufferItems := activeBuffers.Items()
-		metrics.BuffersActive.Update(int64(len(activeBufferItems)))
-
-		uploadCh := make(chan int)
-		for _, item := range activeBufferItems {
-			go func(bufferItem cache.Item, uploadCh chan<- int) {
-				buf := bufferItem.Object.(*LogBuffer)
-				if buf.NeedsFlush() {
-					sumoUploader.UploadLogEntries(buf.Metadata, buf.GetMessages())
-					//done uploading, so clear sent buffer
-					buf.Clear()
-				}
-				uploadCh <- 0
-			}(item, uploadCh)
-		}
+	jr := &JournalReader{Matches: journalMatches}
+	jr.Open(*stateFile)
+	checkpoint := NewCheckpoint(jr.Cursor)
 
-		// Wait for each of the buffer goroutines flush to finish, fire goroutine for every item even if its doesn't
-		// need to flush, easier to know when we are finished that way,
-		for range activeBufferItems {
-			// We can block here for some time (actually will wait indefinitely
-			// for the buffer to upload to Sumo) so we do that in the background
-			// and check for shutdown signals while we wait.
-			select {
-			case _ = <-sigCh: // We got SIGINT or SIGTERM
-				break MainLoop
-			case _ = <-uploadCh: // We successfully uploaded to Sumo
-			}
-		}
+	excludeSumoCategories := Split(os.Getenv("SUMO_EXCLUDE_SOURCE_CATEGORIES"), ",")
+	if len(excludeSumoCategories) > 0 {
+		log.Println("Excluding messages for sumo source categories: ", excludeSumoCategories)
+	}
 
-		close(uploadCh)
+	metrics.Start(*metricsArg)
+	if *healthAddr != "" {
+		health.Start(*healthAddr)
 	}
 
-	// Don't bother cleaning up or flushing anything.
+	pipeline := &Pipeline{
+		Reader:               jr,
+		Checkpoint:           checkpoint,
+		Spool:                spool,
+		Metrics:              metrics,
+		EventFilters:         eventFilters,
+		FormatMessageFilters: formatMessageFilters,
+		ExcludeCategories:    excludeSumoCategories,
+		Routes:               routes,
+		Outputs:              outputs,
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		pipeline.Run(stop)
+		close(done)
+	}()
+
+	<-sigCh
 	log.Println("Caught signal, shutting down.")
+	deadline := time.Now().Add(*shutdownTimeout)
+	close(stop)
+	<-done
+
+	abandoned := pipeline.Shutdown(deadline)
+	if abandoned > 0 {
+		// Don't wait on uploads that are still in flight, they're out of time
+		log.Printf("Shutdown timed out after %s, abandoned %d messages", *shutdownTimeout, abandoned)
+		os.Exit(1)
+	}
+	spool.Close()
+	log.Println("Shutdown complete, everything delivered.")
 }
 
 func FormatLogEntry(ent *sdjournal.JournalEntry) string {
@@ -187,8 +209,9 @@ func getOrCreateActiveBufferForEntry(ent *sdjournal.JournalEntry) *LogBuffer {
 		metadata := getMetadataForLogEntry(ent)
 		buffer = &LogBuffer{
 			Metadata: metadata,
+			Created:  time.Now(),
 		}
-		err := activeBuffers.Add(bufferIdentifier, buffer, activeBufferExpiry)
+		err := activeBuffers.Add(bufferIdentifier, buffer, cache.NoExpiration)
 		if err != nil {
 			log.Fatalln("Error creating log buffer for: ", bufferIdentifier, err)
 		}
@@ -197,6 +220,30 @@ func getOrCreateActiveBufferForEntry(ent *sdjournal.JournalEntry) *LogBuffer {
 	return buffer.(*LogBuffer)
 }
 
+//returns the buffer for entries like ent that are routed to routes, with the same metadata as buf, the
+//buffer for all of them. Entries from one place can go different ways, so they need a buffer per route.
+func getOrCreateRoutedBuffer(ent *sdjournal.JournalEntry, buf *LogBuffer, routes []string) *LogBuffer {
+	if routes == nil {
+		return buf
+	}
+	bufferIdentifier := getLogBufferIdentifierForEntry(ent) + "->" + strings.Join(routes, ",")
+	routed, found := activeBuffers.Get(bufferIdentifier)
+	if !found {
+		metadata := buf.Metadata
+		metadata.routes = routes
+		routed = &LogBuffer{
+			Metadata: metadata,
+			Created:  time.Now(),
+		}
+		err := activeBuffers.Add(bufferIdentifier, routed, cache.NoExpiration)
+		if err != nil {
+			log.Fatalln("Error creating log buffer for: ", bufferIdentifier, err)
+		}
+	}
+
+	return routed.(*LogBuffer)
+}
+
 func isSumoCategoryExcluded(category string, excludedCategories []string) bool {
 	for _, ex := range excludedCategories {
 		if strings.Contains(category, ex) {
@@ -215,8 +262,8 @@ func getLogBufferIdentifierForEntry(ent *sdjournal.JournalEntry) string {
 			//if we have a containerID then the entry is from docker (or something like it? assume docker for now)
 			return "docker-" + ent.Fields["CONTAINER_ID"]
 		} else {
-			//if no container id, then its systemd but its not docker, so just use the systemd unit name as the value
-			return "systemd-" + ent.Fields["SYSLOG_IDENTIFIER"]
+			//if no container id, then its systemd but its not docker, so use the syslog identifier and the unit, which is part of the metadata
+			return "systemd-" + ent.Fields["SYSLOG_IDENTIFIER"] + "-" + ent.Fields["_SYSTEMD_UNIT"]
 		}
 
 	} else {
@@ -237,6 +284,7 @@ func getMetadataForLogEntry(ent *sdjournal.JournalEntry) MetadataValues {
 			metadataValues = GetMetadataForContainerID(ent.Fields["CONTAINER_ID_FULL"])
 		} else {
 			metadataValues = GetMetadataForProcess("systemd", ent.Fields["SYSLOG_IDENTIFIER"])
+			metadataValues.unit = ent.Fields["_SYSTEMD_UNIT"]
 		}
 	} else {
 		metadataValues = GetMetadataForProcess("journald", ent.Fields["_TRANSPORT"])
@@ -17,6 +17,7 @@ const (
 
 	kKubernetesPodName                = "io.kubernetes.pod.name"
 	kKubernetesPodNamespace           = "io.kubernetes.pod.namespace"
+	kKubernetesContainerName          = "io.kubernetes.container.name"
 	kKubernetesSourceCategoryOverride = "annotation.io." + kSumologicCategoryLabel
 	kKubernetesSourceNameOverride     = "annotation.io." + kSumologicSourceLabel
 
@@ -32,6 +33,97 @@ type MetadataValues struct {
 	category         string
 	host             string
 	trustedTimestamp bool
+	namespace        string            // kubernetes namespace, if any
+	pod              string            // kubernetes pod name, if any
+	owner            string            // name of the pod's owner, e.g. a replicaset or daemonset
+	ownerKind        string            // kind of the pod's owner, e.g. ReplicaSet
+	container        string            // container name, within the pod for kubernetes
+	labels           map[string]string // kubernetes pod labels, if any
+	routes           []string          // outputs to send to, see RoutingRules, nil for all of them
+	collector        string            // name of the collector the pod asked for, one of its namespace's in the CollectorMap
+	image            string            // container image, if any
+	node             string            // kubernetes node name, if any
+	unit             string            // systemd unit, outside of containers
+}
+
+// MetadataValues is persisted in spool segments, so it needs to survive a JSON round trip
+type metadataJSON struct {
+	Source           string            `json:"source"`
+	Category         string            `json:"category"`
+	Host             string            `json:"host"`
+	TrustedTimestamp bool              `json:"trustedTimestamp"`
+	Namespace        string            `json:"namespace,omitempty"`
+	Pod              string            `json:"pod,omitempty"`
+	Owner            string            `json:"owner,omitempty"`
+	OwnerKind        string            `json:"ownerKind,omitempty"`
+	Container        string            `json:"container,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Routes           []string          `json:"routes,omitempty"`
+	Collector        string            `json:"collector,omitempty"`
+	Image            string            `json:"image,omitempty"`
+	Node             string            `json:"node,omitempty"`
+	Unit             string            `json:"unit,omitempty"`
+}
+
+func (m MetadataValues) MarshalJSON() ([]byte, error) {
+	return json.Marshal(metadataJSON{
+		Source:           m.source,
+		Category:         m.category,
+		Host:             m.host,
+		TrustedTimestamp: m.trustedTimestamp,
+		Namespace:        m.namespace,
+		Pod:              m.pod,
+		Owner:            m.owner,
+		OwnerKind:        m.ownerKind,
+		Container:        m.container,
+		Labels:           m.labels,
+		Routes:           m.routes,
+		Collector:        m.collector,
+		Image:            m.image,
+		Node:             m.node,
+		Unit:             m.unit,
+	})
+}
+
+func (m *MetadataValues) UnmarshalJSON(data []byte) error {
+	var v metadataJSON
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*m = MetadataValues{
+		source:           v.Source,
+		category:         v.Category,
+		host:             v.Host,
+		trustedTimestamp: v.TrustedTimestamp,
+		namespace:        v.Namespace,
+		pod:              v.Pod,
+		owner:            v.Owner,
+		ownerKind:        v.OwnerKind,
+		container:        v.Container,
+		labels:           v.Labels,
+		routes:           v.Routes,
+		collector:        v.Collector,
+		image:            v.Image,
+		node:             v.Node,
+		unit:             v.Unit,
+	}
+	return nil
+}
+
+// Returns whether entries with this metadata go to an output, and if so which of
+// its collectors, empty for its default
+func (m MetadataValues) routeTo(output string) (bool, string) {
+	if m.routes == nil {
+		return true, ""
+	}
+	for _, dest := range m.routes {
+		name, collector := splitDestination(dest)
+		if name == output {
+			return true, collector
+		}
+	}
+	return false, ""
 }
 
 func SetMetadataDefaults(defaults MetadataValues) {
@@ -70,11 +162,14 @@ func GetMetadataForContainerID(fullContainerID string) (values MetadataValues) {
 		host:             defaultMetadataValues.host,
 		source:           containerName,
 		trustedTimestamp: false, //default to being untrusted as label/annotation will flag its trusted
+		container:        containerName,
+		image:            container.Image,
 	}
 
 	if strings.HasPrefix(containerName, "k8s_") {
 		//default pod owner name to pod name, some pods don't have an 'owner'
 		podOwnerName := container.Labels[kKubernetesPodName]
+		podOwnerKind := ""
 
 		pod, err := getKubernetesPodInfo(fullContainerID)
 		if err != nil || pod == nil {
@@ -83,10 +178,21 @@ func GetMetadataForContainerID(fullContainerID string) (values MetadataValues) {
 		} else {
 			if len(pod.Metadata.OwnerReferences) > 0 {
 				podOwnerName = pod.Metadata.OwnerReferences[0].Name
+				podOwnerKind = pod.Metadata.OwnerReferences[0].Kind
+			}
+			if len(pod.Metadata.Labels) > 0 {
+				metadata.labels = pod.Metadata.Labels
 			}
+			metadata.collector = pod.Metadata.Annotations.SumologicCollector
+			metadata.node = pod.Spec.NodeName
 		}
 
 		//is kube so get metadata from kube labels / annotations
+		metadata.namespace = container.Labels[kKubernetesPodNamespace]
+		metadata.pod = container.Labels[kKubernetesPodName]
+		metadata.owner = podOwnerName
+		metadata.ownerKind = podOwnerKind
+		metadata.container = container.Labels[kKubernetesContainerName]
 		metadata.category = defaultMetadataValues.category + "/kubernetes/" + container.Labels[kKubernetesPodNamespace] + "/" + podOwnerName
 		metadata.source = container.Labels[kKubernetesPodNamespace] + "." + container.Labels[kKubernetesPodName]
 
@@ -4,6 +4,8 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/syntaqx/go-metrics-datadog"
 	"log"
+	"net"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -21,6 +23,13 @@ type Metrics struct {
 	UploadBytesUncompressed metrics.Counter
 	UploadBytesCompressed   metrics.Counter
 	UploadTime              metrics.Timer
+	SpoolWrites             metrics.Counter
+	SpoolCorrupt            metrics.Counter
+	SpoolDroppedSegments    metrics.Counter
+	SpoolDroppedBytes       metrics.Counter
+	SpoolSegments           metrics.Gauge
+	SpoolBytes              metrics.Gauge
+	EntriesQueued           metrics.Gauge
 }
 
 func (m *Metrics) Init() {
@@ -40,6 +49,13 @@ func (m *Metrics) Init() {
 	m.UploadBytesUncompressed = metrics.NewCounter()
 	m.UploadBytesCompressed = metrics.NewCounter()
 	m.UploadTime = metrics.NewTimer()
+	m.SpoolWrites = metrics.NewCounter()
+	m.SpoolCorrupt = metrics.NewCounter()
+	m.SpoolDroppedSegments = metrics.NewCounter()
+	m.SpoolDroppedBytes = metrics.NewCounter()
+	m.SpoolSegments = metrics.NewGauge()
+	m.SpoolBytes = metrics.NewGauge()
+	m.EntriesQueued = metrics.NewGauge()
 
 	_ = m.Registry.Register("debug.dup_cursor.count", m.DebugDupCursor)
 	_ = m.Registry.Register("debug.skipped_cursor.count", m.DebugSkippedCursor)
@@ -52,6 +68,39 @@ func (m *Metrics) Init() {
 	_ = m.Registry.Register("upload.bytes.uncompressed.count", m.UploadBytesUncompressed)
 	_ = m.Registry.Register("upload.bytes.compressed.count", m.UploadBytesCompressed)
 	_ = m.Registry.Register("upload.time_ms", m.UploadTime)
+	_ = m.Registry.Register("spool.writes.count", m.SpoolWrites)
+	_ = m.Registry.Register("spool.corrupt.count", m.SpoolCorrupt)
+	_ = m.Registry.Register("spool.dropped.segments.count", m.SpoolDroppedSegments)
+	_ = m.Registry.Register("spool.dropped.bytes.count", m.SpoolDroppedBytes)
+	_ = m.Registry.Register("spool.segments.gauge", m.SpoolSegments)
+	_ = m.Registry.Register("spool.bytes.gauge", m.SpoolBytes)
+	_ = m.Registry.Register("pipeline.entries_queued.gauge", m.EntriesQueued)
+}
+
+// Metrics for a single output, registered under "output.<name>."
+type OutputMetrics struct {
+	UploadSuccess      metrics.Counter
+	UploadFailure      metrics.Counter // every failed attempt, whatever the class
+	UploadMessages     metrics.Counter
+	UploadThrottled    metrics.Counter
+	UploadUnauthorized metrics.Counter
+	UploadRejected     metrics.Counter
+	DeadLetterMessages metrics.Counter
+	Healthy            metrics.Gauge // 0 while the output is rejecting our credentials
+}
+
+func (m *Metrics) ForOutput(name string) *OutputMetrics {
+	prefix := "output." + name + "."
+	return &OutputMetrics{
+		UploadSuccess:      metrics.GetOrRegisterCounter(prefix+"upload.success", m.Registry),
+		UploadFailure:      metrics.GetOrRegisterCounter(prefix+"upload.failure", m.Registry),
+		UploadMessages:     metrics.GetOrRegisterCounter(prefix+"upload.messages.count", m.Registry),
+		UploadThrottled:    metrics.GetOrRegisterCounter(prefix+"upload.throttled", m.Registry),
+		UploadUnauthorized: metrics.GetOrRegisterCounter(prefix+"upload.unauthorized", m.Registry),
+		UploadRejected:     metrics.GetOrRegisterCounter(prefix+"upload.rejected", m.Registry),
+		DeadLetterMessages: metrics.GetOrRegisterCounter(prefix+"deadletter.messages.count", m.Registry),
+		Healthy:            metrics.GetOrRegisterGauge(prefix+"healthy.gauge", m.Registry),
+	}
 }
 
 func (m *Metrics) Start(metricsArg string) {
@@ -76,6 +125,23 @@ func (m *Metrics) Start(metricsArg string) {
 		reporter.Client.Namespace = "log_forwarder."
 		go reporter.Flush()
 		log.Println("metrics reporting to dogstatd at: ", dogStatsdAddr)
+	} else if strings.HasPrefix(metricsArg, "prometheus") {
+		prometheusAddr := DefaultPrometheusAddr
+		bits := strings.Split(metricsArg, ",")
+		if len(bits) > 1 {
+			prometheusAddr = bits[1]
+		}
+		//listen up front so a bad address fails at startup rather than in the background
+		listener, err := net.Listen("tcp", prometheusAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", PrometheusHandler(m.Registry))
+		go func() {
+			log.Fatal(http.Serve(listener, mux))
+		}()
+		log.Println("metrics available for prometheus at: ", prometheusAddr)
 	} else {
 		log.Fatal("unknown metrics provider: ", metricsArg)
 	}
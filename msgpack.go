@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Just enough MessagePack for the fluentd forward protocol.
+// See: https://github.com/msgpack/msgpack/blob/master/spec.md
+
+func msgpackAppendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= 0xffff:
+		return append(b, 0xdc, byte(n>>8), byte(n))
+	default:
+		return append(b, 0xdd, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func msgpackAppendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= 0xffff:
+		return append(b, 0xde, byte(n>>8), byte(n))
+	default:
+		return append(b, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func msgpackAppendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= 0xff:
+		b = append(b, 0xd9, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, s...)
+}
+
+func msgpackAppendBinary(b []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n <= 0xff:
+		b = append(b, 0xc4, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0xc5, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, data...)
+}
+
+func msgpackAppendInt(b []byte, n int) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	default:
+		return append(b, 0xd3, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32), byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+// Sorted by key, so the encoding is the same every time
+func msgpackAppendStringMap(b []byte, m map[string]string) []byte {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = msgpackAppendMapHeader(b, len(keys))
+	for _, k := range keys {
+		b = msgpackAppendString(b, k)
+		b = msgpackAppendString(b, m[k])
+	}
+	return b
+}
+
+// Fluentd's EventTime extension type, seconds and nanoseconds
+func msgpackAppendEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint32(b[len(b)-8:], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(t.Nanosecond()))
+	return b
+}
+
+// Reads a map of strings, or binary, to strings, e.g. a fluentd ack
+func msgpackReadStringMap(r *bufio.Reader) (map[string]string, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch {
+	case c&0xf0 == 0x80:
+		n = int(c & 0x0f)
+	case c == 0xde:
+		n, err = msgpackReadLength(r, 2)
+	case c == 0xdf:
+		n, err = msgpackReadLength(r, 4)
+	default:
+		return nil, fmt.Errorf("expected a msgpack map, got type 0x%x", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]string{}
+	for i := 0; i < n; i++ {
+		k, err := msgpackReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := msgpackReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+func msgpackReadString(r *bufio.Reader) (string, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xd9 || c == 0xc4:
+		n, err = msgpackReadLength(r, 1)
+	case c == 0xda || c == 0xc5:
+		n, err = msgpackReadLength(r, 2)
+	case c == 0xdb || c == 0xc6:
+		n, err = msgpackReadLength(r, 4)
+	default:
+		return "", fmt.Errorf("expected a msgpack string, got type 0x%x", c)
+	}
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, n)
+	_, err = io.ReadFull(r, s)
+	return string(s), err
+}
+
+func msgpackReadLength(r *bufio.Reader, size int) (int, error) {
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OTLPOutput exports entries to an OpenTelemetry collector with OTLP/HTTP, JSON encoded.
+// See: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+//
+// A batch is a single resource, described by its host and kubernetes metadata. Each
+// entry is a log record with the severity from the journal's PRIORITY, its journal
+// fields as attributes, and the trace context from TRACE_ID and SPAN_ID if they are
+// set and valid.
+type OTLPOutput struct {
+	httpClient *http.Client
+	URL        string            // e.g http://otel-collector:4318, /v1/logs is added
+	Headers    map[string]string // sent with every request, e.g. for authentication
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"` // 64 bit ints are strings in protobuf JSON
+	SeverityNumber int            `json:"severityNumber,omitempty"`
+	SeverityText   string         `json:"severityText,omitempty"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+	TraceID        string         `json:"traceId,omitempty"` // hex, unlike other bytes fields
+	SpanID         string         `json:"spanId,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpLogsResponse struct {
+	PartialSuccess *struct {
+		RejectedLogRecords json.Number `json:"rejectedLogRecords"`
+		ErrorMessage       string      `json:"errorMessage"`
+	} `json:"partialSuccess"`
+}
+
+// Journal priorities (syslog severities) to OpenTelemetry severity numbers and text
+var otlpSeverities = []struct {
+	number int
+	text   string
+}{
+	{24, "EMERG"},   // FATAL4
+	{23, "ALERT"},   // FATAL3
+	{21, "CRIT"},    // FATAL
+	{17, "ERR"},     // ERROR
+	{13, "WARNING"}, // WARN
+	{10, "NOTICE"},  // INFO2
+	{9, "INFO"},     // INFO
+	{5, "DEBUG"},    // DEBUG
+}
+
+func (otlp *OTLPOutput) Name() string {
+	return "otlp"
+}
+
+func (otlp *OTLPOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	records := make([]otlpLogRecord, 0, len(batch))
+	for _, entry := range batch {
+		records = append(records, otlpRecord(entry))
+	}
+	body, err := json.Marshal(otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: otlpResource{Attributes: otlpResourceAttributes(metadata)},
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "log-forwarder"},
+			LogRecords: records,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(otlp.URL, "/")+"/v1/logs", bytes.NewReader(compress(string(body))))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range otlp.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := otlp.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading otlp response: %s", err)
+	}
+	err = HTTPResponseError(resp, respBody)
+	if err != nil {
+		return err
+	}
+
+	// The collector doesn't say which records it dropped, so all we can do is report it
+	var logsResp otlpLogsResponse
+	if json.Unmarshal(respBody, &logsResp) == nil && logsResp.PartialSuccess != nil {
+		rejected, _ := logsResp.PartialSuccess.RejectedLogRecords.Int64()
+		if rejected > 0 {
+			log.Printf("otlp collector rejected %d of %d log records: %s\n", rejected, len(batch), logsResp.PartialSuccess.ErrorMessage)
+		}
+	}
+	return nil
+}
+
+func otlpRecord(entry LogEntry) otlpLogRecord {
+	record := otlpLogRecord{
+		TimeUnixNano: strconv.FormatUint(entry.Timestamp*1000, 10),
+		Body:         otlpAnyValue{StringValue: entry.Message},
+	}
+	if priority, err := strconv.Atoi(entry.Fields["PRIORITY"]); err == nil && priority >= 0 && priority < len(otlpSeverities) {
+		record.SeverityNumber = otlpSeverities[priority].number
+		record.SeverityText = otlpSeverities[priority].text
+	}
+
+	traceID := entry.Fields["TRACE_ID"]
+	spanID := entry.Fields["SPAN_ID"]
+	if validOTLPID(traceID, 16) {
+		record.TraceID = strings.ToLower(traceID)
+		if validOTLPID(spanID, 8) {
+			record.SpanID = strings.ToLower(spanID)
+		}
+	}
+
+	// Everything else is an attribute, including the fields above if they weren't valid
+	used := map[string]bool{
+		"MESSAGE":  true,
+		"PRIORITY": record.SeverityNumber != 0,
+		"TRACE_ID": record.TraceID != "",
+		"SPAN_ID":  record.SpanID != "",
+	}
+	var names []string
+	for name := range entry.Fields {
+		if !used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		record.Attributes = append(record.Attributes, otlpKeyValue{name, otlpAnyValue{entry.Fields[name]}})
+	}
+	return record
+}
+
+// Trace and span ids are hex of a fixed number of bytes, and not all zeros
+func validOTLPID(id string, size int) bool {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != size {
+		return false
+	}
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Resource attributes, named by the OpenTelemetry semantic conventions
+func otlpResourceAttributes(metadata MetadataValues) []otlpKeyValue {
+	var attributes []otlpKeyValue
+	add := func(key string, value string) {
+		if value != "" {
+			attributes = append(attributes, otlpKeyValue{key, otlpAnyValue{value}})
+		}
+	}
+	add("service.name", metadata.source)
+	add("host.name", metadata.host)
+	add("k8s.namespace.name", metadata.namespace)
+	add("k8s.pod.name", metadata.pod)
+	if metadata.ownerKind != "" {
+		// e.g. k8s.replicaset.name, k8s.daemonset.name
+		add("k8s."+strings.ToLower(metadata.ownerKind)+".name", metadata.owner)
+	}
+	add("k8s.container.name", metadata.container)
+	add("log.category", metadata.category)
+	return attributes
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testOTLPCollector is a stand in for an OpenTelemetry collector, recording what it gets
+type testOTLPCollector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	response string
+	requests []otlpLogsRequest
+	headers  []http.Header
+}
+
+func newTestOTLPCollector(response string) *testOTLPCollector {
+	c := &testOTLPCollector{response: response}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		gz, err := gzip.NewReader(r.Body)
+		if r.URL.Path != "/v1/logs" || err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		var req otlpLogsRequest
+		if json.NewDecoder(gz).Decode(&req) != nil {
+			w.WriteHeader(400)
+			return
+		}
+		c.requests = append(c.requests, req)
+		c.headers = append(c.headers, r.Header)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, c.response)
+	}))
+	return c
+}
+
+func TestOTLPExport(t *testing.T) {
+	collector := newTestOTLPCollector(`{}`)
+	defer collector.Close()
+	otlp := &OTLPOutput{
+		httpClient: &http.Client{},
+		URL:        collector.URL + "/",
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+	}
+
+	metadata := MetadataValues{
+		category:  "prod/kubernetes/kube-system/kube-proxy-abcde",
+		source:    "kube-system.kube-proxy",
+		host:      "node-1",
+		namespace: "kube-system",
+		pod:       "kube-proxy-abcde",
+		owner:     "kube-proxy",
+		ownerKind: "DaemonSet",
+		container: "kube-proxy",
+	}
+	batch := []LogEntry{
+		{
+			Timestamp: 1563537600123456,
+			Message:   "traced",
+			Fields: map[string]string{
+				"MESSAGE":           "traced",
+				"PRIORITY":          "3",
+				"SYSLOG_IDENTIFIER": "kube-proxy",
+				"TRACE_ID":          "4BF92F3577B34DA6A3CE929D0E0E4736",
+				"SPAN_ID":           "00f067aa0ba902b7",
+			},
+		},
+		{
+			Timestamp: 1563537601000000,
+			Message:   "not traced",
+			Fields: map[string]string{
+				"PRIORITY": "high",
+				"TRACE_ID": "00000000000000000000000000000000",
+			},
+		},
+	}
+	assert.NoError(t, otlp.Send(context.Background(), metadata, batch))
+
+	assert.Len(t, collector.requests, 1)
+	assert.Equal(t, "Bearer token", collector.headers[0].Get("Authorization"))
+	resourceLogs := collector.requests[0].ResourceLogs
+	assert.Len(t, resourceLogs, 1)
+	assert.Equal(t, []otlpKeyValue{
+		{"service.name", otlpAnyValue{"kube-system.kube-proxy"}},
+		{"host.name", otlpAnyValue{"node-1"}},
+		{"k8s.namespace.name", otlpAnyValue{"kube-system"}},
+		{"k8s.pod.name", otlpAnyValue{"kube-proxy-abcde"}},
+		{"k8s.daemonset.name", otlpAnyValue{"kube-proxy"}},
+		{"k8s.container.name", otlpAnyValue{"kube-proxy"}},
+		{"log.category", otlpAnyValue{"prod/kubernetes/kube-system/kube-proxy-abcde"}},
+	}, resourceLogs[0].Resource.Attributes)
+	assert.Equal(t, []otlpLogRecord{
+		{
+			TimeUnixNano:   "1563537600123456000",
+			SeverityNumber: 17,
+			SeverityText:   "ERR",
+			Body:           otlpAnyValue{"traced"},
+			Attributes:     []otlpKeyValue{{"SYSLOG_IDENTIFIER", otlpAnyValue{"kube-proxy"}}},
+			TraceID:        "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanID:         "00f067aa0ba902b7",
+		},
+		{
+			// Not valid, so left as attributes
+			TimeUnixNano: "1563537601000000000",
+			Body:         otlpAnyValue{"not traced"},
+			Attributes: []otlpKeyValue{
+				{"PRIORITY", otlpAnyValue{"high"}},
+				{"TRACE_ID", otlpAnyValue{"00000000000000000000000000000000"}},
+			},
+		},
+	}, resourceLogs[0].ScopeLogs[0].LogRecords)
+}
+
+func TestOTLPPartialSuccess(t *testing.T) {
+	collector := newTestOTLPCollector(`{"partialSuccess":{"rejectedLogRecords":"1","errorMessage":"too old"}}`)
+	defer collector.Close()
+	otlp := &OTLPOutput{httpClient: &http.Client{}, URL: collector.URL}
+
+	// Accepted, there's no telling which was rejected
+	assert.NoError(t, otlp.Send(context.Background(), MetadataValues{}, testEntries("one", "two")))
+}
+
+func TestOTLPSeverities(t *testing.T) {
+	for priority, expected := range []int{24, 23, 21, 17, 13, 10, 9, 5} {
+		record := otlpRecord(LogEntry{Fields: map[string]string{"PRIORITY": fmt.Sprint(priority)}})
+		assert.Equal(t, expected, record.SeverityNumber)
+	}
+	assert.Equal(t, 0, otlpRecord(LogEntry{Fields: map[string]string{"PRIORITY": "8"}}).SeverityNumber)
+}
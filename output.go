@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-systemd/sdjournal"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LogEntry is a journal entry as it is carried through buffers and the spool to outputs
+type LogEntry struct {
+	Cursor    string            `json:"cursor"`
+	Timestamp uint64            `json:"timestamp"` // journal realtime timestamp, microseconds since the epoch
+	Message   string            `json:"message"`   // the line as it should be sent, possibly formatted
+	Fields    map[string]string `json:"fields"`    // all the journal fields
+}
+
+func NewLogEntry(ent *sdjournal.JournalEntry, message string) LogEntry {
+	return LogEntry{
+		Cursor:    ent.Cursor,
+		Timestamp: ent.RealtimeTimestamp,
+		Message:   message,
+		Fields:    ent.Fields,
+	}
+}
+
+// An entry with its metadata, for outputs that send each entry as a JSON object
+type jsonRecord struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Message   string            `json:"message"`
+	Cursor    string            `json:"cursor"`
+	Category  string            `json:"category"`
+	Source    string            `json:"source"`
+	Host      string            `json:"host"`
+	Namespace string            `json:"namespace,omitempty"`
+	Pod       string            `json:"pod,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Container string            `json:"container,omitempty"`
+	Fields    map[string]string `json:"fields"`
+}
+
+func newJSONRecord(metadata MetadataValues, entry LogEntry) jsonRecord {
+	return jsonRecord{
+		Timestamp: entryTime(entry),
+		Message:   entry.Message,
+		Cursor:    entry.Cursor,
+		Category:  metadata.category,
+		Source:    metadata.source,
+		Host:      metadata.host,
+		Namespace: metadata.namespace,
+		Pod:       metadata.pod,
+		Owner:     metadata.owner,
+		Container: metadata.container,
+		Fields:    entry.Fields,
+	}
+}
+
+// Output is somewhere we send batches of log entries to
+type Output interface {
+	// Name is used for metrics, logging and to track the output's place in the spool
+	Name() string
+
+	// Make one attempt at sending a batch, giving up when ctx is done. Returns an
+	// error if it wasn't accepted, in which case it will be retried.
+	Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error
+}
+
+// Outputs that need batches delivered one at a time, in the order they were spooled,
+// implement this and return true. They only get one worker.
+type OrderedOutput interface {
+	Ordered() bool
+}
+
+// Outputs with work of their own to do in the background, like uploading what they
+// have staged, implement this. The pipeline runs them until it is stopped, then
+// calls Flush on shutdown, which returns how many messages it couldn't deliver by
+// deadline.
+type BackgroundOutput interface {
+	Run(stop <-chan struct{})
+	Flush(deadline time.Time) int
+}
+
+// Creates an output by name, configured from the environment
+func MakeOutput(name string, metrics *Metrics) Output {
+	switch name {
+	case "sumo":
+		output := &SumoUploader{
+			httpClient:                             &http.Client{},
+			Metrics:                                metrics,
+			TrustedTimestampCollectorUrl:           MustGetEnv("SUMO_TRUSTED_TIMESTAMP_COLLECTOR_URL", "SUMO_COLLECTOR_URL"),
+			UntrustedTimestampCollectorUrl:         MustGetEnv("SUMO_UNTRUSTED_TIMESTAMP_COLLECTOR_URL", "SUMO_COLLECTOR_URL"),
+			Collectors:                             GetEnvByPrefix("SUMO_COLLECTOR_URL_"),
+			StaticFields:                           ParseHeaders(os.Getenv("SUMO_FIELDS")),
+			FailoverTrustedTimestampCollectorUrl:   GetEnv("SUMO_FAILOVER_TRUSTED_TIMESTAMP_COLLECTOR_URL", os.Getenv("SUMO_FAILOVER_COLLECTOR_URL")),
+			FailoverUntrustedTimestampCollectorUrl: GetEnv("SUMO_FAILOVER_UNTRUSTED_TIMESTAMP_COLLECTOR_URL", os.Getenv("SUMO_FAILOVER_COLLECTOR_URL")),
+			FailoverAfter:                          GetEnvDuration("SUMO_FAILOVER_AFTER", DefaultFailoverAfter),
+			FailoverProbeInterval:                  GetEnvDuration("SUMO_FAILOVER_PROBE_INTERVAL", DefaultFailoverProbeInterval),
+			BreakerThreshold:                       GetEnvInt("SUMO_BREAKER_THRESHOLD", DefaultBreakerThreshold),
+			BreakerCoolDown:                        GetEnvDuration("SUMO_BREAKER_COOLDOWN", DefaultBreakerCoolDown),
+		}
+		if path := os.Getenv("SUMO_COLLECTOR_MAP_FILE"); path != "" {
+			collectorMap, err := LoadCollectorMap(path)
+			if err != nil {
+				log.Fatalln("Error loading sumo collector map: ", err)
+			}
+			output.CollectorMap = collectorMap
+			log.Println("Tenant collectors from: ", path)
+		}
+		output.FieldAllowlist = DefaultSumoFieldAllowlist
+		if allowlist, ok := os.LookupEnv("SUMO_FIELDS_ALLOWLIST"); ok {
+			//set but empty sends none of them
+			output.FieldAllowlist = Split(allowlist, ",")
+			for _, name := range output.FieldAllowlist {
+				if SumoMetadataFields[name] == nil {
+					log.Fatalln("Unknown field in SUMO_FIELDS_ALLOWLIST: ", name)
+				}
+			}
+		}
+		return output
+	case "file":
+		return &FileOutput{
+			Path:          GetEnv("FILE_OUTPUT_PATH", DefaultFileOutputPath),
+			PerCategory:   os.Getenv("FILE_OUTPUT_PER_CATEGORY") == "true",
+			Compress:      os.Getenv("FILE_OUTPUT_GZIP") == "true",
+			MaxBytes:      int64(GetEnvInt("FILE_OUTPUT_MAX_SIZE_MB", 0)) * 1024 * 1024,
+			MaxAge:        GetEnvDuration("FILE_OUTPUT_MAX_AGE", 0),
+			MaxOldFiles:   GetEnvInt("FILE_OUTPUT_MAX_OLD_FILES", 0),
+			MaxTotalBytes: int64(GetEnvInt("FILE_OUTPUT_MAX_TOTAL_MB", 0)) * 1024 * 1024,
+		}
+	case "loki":
+		return &LokiOutput{
+			httpClient: &http.Client{},
+			URL:        MustGetEnv("LOKI_URL"),
+			TenantID:   os.Getenv("LOKI_TENANT_ID"),
+			Username:   os.Getenv("LOKI_USERNAME"),
+			Password:   os.Getenv("LOKI_PASSWORD"),
+		}
+	case "splunk":
+		return &SplunkOutput{
+			httpClient: &http.Client{},
+			URL:        MustGetEnv("SPLUNK_HEC_URL"),
+			Token:      MustGetEnv("SPLUNK_HEC_TOKEN"),
+			Index:      os.Getenv("SPLUNK_INDEX"),
+			SourceType: os.Getenv("SPLUNK_SOURCETYPE"),
+		}
+	case "syslog":
+		output := &SyslogOutput{
+			Addr: MustGetEnv("SYSLOG_ADDR"),
+			SDID: GetEnv("SYSLOG_SD_ID", DefaultSyslogSDID),
+		}
+		if os.Getenv("SYSLOG_TLS") == "true" {
+			config, err := SyslogTLSConfig(os.Getenv("SYSLOG_TLS_CA_FILE"), os.Getenv("SYSLOG_TLS_SERVER_NAME"))
+			if err != nil {
+				log.Fatalln("Error configuring syslog TLS: ", err)
+			}
+			output.TLS = config
+		}
+		return output
+	case "otlp":
+		return &OTLPOutput{
+			httpClient: &http.Client{},
+			URL:        MustGetEnv("OTLP_URL"),
+			Headers:    ParseHeaders(os.Getenv("OTLP_HEADERS")),
+		}
+	case "gelf":
+		protocol := GetEnv("GELF_PROTOCOL", "tcp")
+		if protocol != "tcp" && protocol != "udp" {
+			log.Fatalln("GELF_PROTOCOL must be tcp or udp, not: ", protocol)
+		}
+		return &GELFOutput{
+			Addr:      MustGetEnv("GELF_ADDR"),
+			Protocol:  protocol,
+			Fields:    strings.Split(GetEnv("GELF_FIELDS", DefaultGELFFields), ","),
+			ChunkSize: GetEnvInt("GELF_CHUNK_SIZE", DefaultGELFChunkSize),
+		}
+	case "fluentd":
+		return &FluentdOutput{Addr: MustGetEnv("FLUENTD_ADDR")}
+	case "webhook":
+		format := GetEnv("WEBHOOK_FORMAT", WebhookFormatJSON)
+		if format != WebhookFormatJSON && format != WebhookFormatNDJSON {
+			log.Fatalln("WEBHOOK_FORMAT must be json or ndjson, not: ", format)
+		}
+		output := &WebhookOutput{
+			httpClient:  &http.Client{},
+			URL:         MustGetEnv("WEBHOOK_URL"),
+			Format:      format,
+			Headers:     ParseHeaders(os.Getenv("WEBHOOK_HEADERS")),
+			Username:    os.Getenv("WEBHOOK_USERNAME"),
+			Password:    os.Getenv("WEBHOOK_PASSWORD"),
+			BearerToken: os.Getenv("WEBHOOK_BEARER_TOKEN"),
+			Compress:    os.Getenv("WEBHOOK_GZIP") == "true",
+		}
+		if text := os.Getenv("WEBHOOK_TEMPLATE"); text != "" {
+			tmpl, err := ParseWebhookTemplate(text)
+			if err != nil {
+				log.Fatalln("Error parsing WEBHOOK_TEMPLATE: ", err)
+			}
+			output.Template = tmpl
+		}
+		return output
+	case "datadog":
+		return &DatadogLogsOutput{
+			httpClient: &http.Client{},
+			URL:        GetEnv("DD_LOGS_URL", DefaultDatadogLogsURL),
+			APIKey:     MustGetEnv("DD_API_KEY"),
+			Tags: strings.FieldsFunc(os.Getenv("DD_TAGS"), func(r rune) bool {
+				return r == ',' || r == ' '
+			}),
+		}
+	case "s3":
+		region := GetEnv("S3_REGION", "us-east-1")
+		partSizeMB := GetEnvInt("S3_PART_SIZE_MB", DefaultS3PartSizeMB)
+		if partSizeMB < 5 {
+			log.Fatalln("S3_PART_SIZE_MB must be at least 5, S3 doesn't accept smaller parts")
+		}
+		output := &S3Output{
+			Client: &S3Client{
+				httpClient:   &http.Client{},
+				Endpoint:     GetEnv("S3_ENDPOINT", "https://s3."+region+".amazonaws.com"),
+				Region:       region,
+				Bucket:       MustGetEnv("S3_BUCKET"),
+				AccessKey:    MustGetEnv("AWS_ACCESS_KEY_ID"),
+				SecretKey:    MustGetEnv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			},
+			Prefix:          os.Getenv("S3_PREFIX"),
+			StagingDir:      GetEnv("S3_STAGING_DIR", DefaultS3StagingDir),
+			MaxObjectBytes:  int64(GetEnvInt("S3_MAX_OBJECT_MB", DefaultS3MaxObjectMB)) * 1024 * 1024,
+			MaxObjectAge:    GetEnvDuration("S3_MAX_OBJECT_AGE", DefaultS3MaxObjectAge),
+			PartSize:        partSizeMB * 1024 * 1024,
+			UploadTimeout:   GetEnvDuration("S3_UPLOAD_TIMEOUT", DefaultS3UploadTimeout),
+			MaxStagingBytes: int64(GetEnvInt("S3_MAX_STAGING_MB", DefaultS3MaxStagingMB)) * 1024 * 1024,
+		}
+		return output
+	case "elasticsearch":
+		return &ElasticsearchOutput{
+			httpClient: &http.Client{},
+			URL:        MustGetEnv("ES_URL"),
+			Username:   os.Getenv("ES_USERNAME"),
+			Password:   os.Getenv("ES_PASSWORD"),
+			Index:      GetEnv("ES_INDEX", DefaultElasticsearchIndex),
+			DateFormat: GetEnv("ES_DATE_FORMAT", DefaultElasticsearchDateFormat),
+		}
+	default:
+		log.Fatalln("Unknown output: ", name)
+		return nil
+	}
+}
+
+// OutputWorker delivers batches to a single output, retrying with backoff until the
+// output accepts them. Each output has its own workers, so one that is slow or failing
+// doesn't hold up the others. A worker handles one batch at a time, run several to
+// upload to the same output concurrently.
+//
+// How a failure is retried depends on the error Send returns, see output_errors.go:
+// throttling honours Retry-After, rejected credentials are reported to the health
+// check, batches the output will never accept are moved to DeadLetterDir, and if
+// only part of a batch failed only that part is retried.
+type OutputWorker struct {
+	Output  Output
+	Metrics *OutputMetrics
+
+	// Limit on each attempt at sending a batch, no limit if zero
+	Timeout time.Duration
+
+	// Where batches the output rejected outright are kept for someone to look at.
+	// If empty they are dropped.
+	DeadLetterDir string
+
+	// Number of consecutive failed attempts, drives the backoff
+	failures int
+
+	// Waits for d, returns false if stop was closed first. Replaced in tests.
+	sleep func(d time.Duration, stop <-chan struct{}) bool
+}
+
+func NewOutputWorker(output Output, metrics *Metrics) *OutputWorker {
+	w := &OutputWorker{
+		Output:  output,
+		Metrics: metrics.ForOutput(output.Name()),
+		Timeout: DefaultUploadTimeout,
+		sleep:   sleep,
+	}
+	w.Metrics.Healthy.Update(1)
+	return w
+}
+
+// Blocks until the batch has been delivered or dead lettered, returns false if stop was closed first
+func (w *OutputWorker) Deliver(metadata MetadataValues, batch []LogEntry, stop <-chan struct{}) bool {
+	name := w.Output.Name()
+	if routed, _ := metadata.routeTo(name); !routed {
+		// Routed to other outputs, nothing to do
+		return true
+	}
+	var wait time.Duration
+	for {
+		if wait > 0 {
+			log.Printf("%s: Backing off for %s", name, wait)
+			if !w.sleep(wait, stop) {
+				return false
+			}
+		}
+
+		err := w.send(metadata, batch, stop)
+		if err == nil {
+			w.failures = 0
+			w.Metrics.UploadSuccess.Inc(1)
+			w.Metrics.UploadMessages.Inc(int64(len(batch)))
+			w.Metrics.Healthy.Update(1)
+			health.Recover("output " + name)
+			return true
+		}
+
+		if e, ok := err.(*CircuitOpenError); ok {
+			// Nothing was sent, so this isn't another failure
+			wait = withJitter(e.RetryAfter)
+			continue
+		}
+
+		w.failures++
+		w.Metrics.UploadFailure.Inc(1)
+		wait = time.Duration(backoff(w.failures)) * time.Second
+		switch e := err.(type) {
+		case *ThrottledError, *UnauthorizedError:
+			wait = w.outputFailed(err, wait)
+		case *RejectedError:
+			w.Metrics.UploadRejected.Inc(1)
+			log.Printf("%s: Batch of %d messages rejected, dead lettering it: %s", name, len(batch), err)
+			w.deadLetter(metadata, batch, err)
+			w.failures = 0
+			return true
+		case *PartialError:
+			w.Metrics.UploadMessages.Inc(int64(len(batch) - len(e.Retry) - len(e.Rejected)))
+			if len(e.Rejected) > 0 {
+				w.Metrics.UploadRejected.Inc(1)
+				log.Printf("%s: %d messages rejected, dead lettering them: %s", name, len(e.Rejected), err)
+				w.deadLetter(metadata, e.Rejected, err)
+			}
+			if len(e.Retry) == 0 {
+				w.failures = 0
+				return true
+			}
+			log.Printf("%s: %d of %d messages failed, retrying them: %s", name, len(e.Retry), len(batch), err)
+			batch = e.Retry
+			wait = w.outputFailed(e.Err, wait)
+		default:
+			log.Printf("%s: Error uploading logs: %s", name, err)
+		}
+	}
+}
+
+// Handles errors about the output rather than the batch, returns how long to wait
+// before retrying: throttling honours Retry-After, and rejected credentials fail the
+// health check
+func (w *OutputWorker) outputFailed(err error, wait time.Duration) time.Duration {
+	name := w.Output.Name()
+	switch e := err.(type) {
+	case *ThrottledError:
+		w.Metrics.UploadThrottled.Inc(1)
+		if e.RetryAfter > 0 {
+			wait = e.RetryAfter
+		}
+		// Spread out the retries so the workers don't all come back at once
+		wait = withJitter(wait)
+		log.Printf("%s: Throttled: %s", name, err)
+	case *UnauthorizedError:
+		w.Metrics.UploadUnauthorized.Inc(1)
+		w.Metrics.Healthy.Update(0)
+		health.Fail("output "+name, err.Error())
+		log.Printf("%s: ERROR: %s. Check the configured URL and credentials, nothing will be delivered until they're fixed!", name, err)
+	}
+	return wait
+}
+
+// Makes one attempt with the timeout, abandoning it if stop is closed
+func (w *OutputWorker) send(metadata MetadataValues, batch []LogEntry, stop <-chan struct{}) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if w.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), w.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return w.Output.Send(ctx, metadata, batch)
+}
+
+type deadLetter struct {
+	Output   string         `json:"output"`
+	Error    string         `json:"error"`
+	Metadata MetadataValues `json:"metadata"`
+	Entries  []LogEntry     `json:"entries"`
+}
+
+func (w *OutputWorker) deadLetter(metadata MetadataValues, batch []LogEntry, reason error) {
+	w.Metrics.DeadLetterMessages.Inc(int64(len(batch)))
+	if w.DeadLetterDir == "" {
+		return
+	}
+	dir := filepath.Join(w.DeadLetterDir, w.Output.Name())
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		log.Println("Error creating dead letter dir: ", err)
+		return
+	}
+	data, err := json.Marshal(deadLetter{w.Output.Name(), reason.Error(), metadata, batch})
+	if err != nil {
+		log.Println("Error encoding dead letter: ", err)
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json.gz", time.Now().UnixNano()))
+	err = ioutil.WriteFile(path, compress(string(data)), os.FileMode(0600))
+	if err != nil {
+		log.Println("Error writing dead letter: ", err)
+	}
+}
+
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Adds up to 20% to d
+func withJitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Longest we will honour a Retry-After for, in case a server asks for something silly
+const MaxRetryAfter = 5 * time.Minute
+
+// Send returns one of these errors when a retry should be handled differently to
+// an ordinary failure, see OutputWorker.Deliver. Anything else is retried with backoff.
+
+// The output is shedding load (e.g. 429 or 503). Retry after RetryAfter, or with
+// backoff if it didn't say.
+type ThrottledError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("throttled, status code: %d, retry after: %s", e.StatusCode, e.RetryAfter)
+}
+
+// The output rejected our credentials (e.g. 401). Needs someone to fix the configuration.
+type UnauthorizedError struct {
+	StatusCode int
+}
+
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("credentials rejected, status code: %d", e.StatusCode)
+}
+
+// The output will never accept this batch (e.g. 400 or 413), retrying won't help.
+type RejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("batch rejected, status code: %d: %s", e.StatusCode, e.Body)
+}
+
+// Some of the batch was accepted and some wasn't, e.g. per item errors in a bulk
+// request. Only Retry is sent again, Rejected will never be accepted.
+type PartialError struct {
+	Retry    []LogEntry
+	Rejected []LogEntry
+	Err      error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// Classifies the response to an upload. Returns nil for a 2xx, otherwise one of the
+// errors above, or a plain error for anything that is worth retrying as normal
+// (5xx, 408 request timeout).
+func HTTPResponseError(resp *http.Response, body []byte) error {
+	code := resp.StatusCode
+	switch {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		return &ThrottledError{StatusCode: code, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return &UnauthorizedError{StatusCode: code}
+	case code == http.StatusRequestTimeout:
+		return fmt.Errorf("request timed out, status code: %d", code)
+	case code >= 400 && code < 500:
+		return &RejectedError{StatusCode: code, Body: truncate(string(body), 200)}
+	default:
+		return fmt.Errorf("failed upload, status code: %d", code)
+	}
+}
+
+// Returns true if err says the endpoint is unhealthy (unreachable, timing out,
+// erroring or throttling us) as opposed to it working but not liking what we sent.
+// Used to drive circuit breakers.
+func EndpointFailed(err error) bool {
+	switch err.(type) {
+	case nil, *RejectedError, *UnauthorizedError:
+		return false
+	default:
+		return true
+	}
+}
+
+// Retry-After is either a number of seconds or an HTTP date. Returns 0 if it's
+// missing or can't be parsed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(now)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > MaxRetryAfter {
+		return MaxRetryAfter
+	}
+	return d
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 7, 19, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Fri, 19 Jul 2019 12:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Fri, 19 Jul 2019 11:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, MaxRetryAfter, parseRetryAfter("86400", now))
+}
+
+func TestHTTPResponseError(t *testing.T) {
+	classify := func(code int) error {
+		return HTTPResponseError(&http.Response{StatusCode: code, Header: http.Header{}}, []byte("body"))
+	}
+	assert.NoError(t, classify(200))
+	assert.NoError(t, classify(204))
+	assert.IsType(t, &ThrottledError{}, classify(429))
+	assert.IsType(t, &ThrottledError{}, classify(503))
+	assert.IsType(t, &UnauthorizedError{}, classify(401))
+	assert.IsType(t, &UnauthorizedError{}, classify(403))
+	assert.IsType(t, &RejectedError{}, classify(400))
+	assert.IsType(t, &RejectedError{}, classify(413))
+
+	// Worth retrying as normal
+	for _, code := range []int{408, 500, 502, 504} {
+		switch err := classify(code).(type) {
+		case nil, *ThrottledError, *UnauthorizedError, *RejectedError:
+			t.Errorf("%d: unexpected %#v", code, err)
+		}
+	}
+}
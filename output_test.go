@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+)
+
+// testOutput records what it is sent, and fails every send while failing is set
+type testOutput struct {
+	mu      sync.Mutex
+	name    string
+	failing bool
+	batches [][]LogEntry
+}
+
+func (o *testOutput) Name() string {
+	if o.name == "" {
+		return "test"
+	}
+	return o.name
+}
+
+func (o *testOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failing {
+		return errors.New("failing")
+	}
+	o.batches = append(o.batches, batch)
+	return nil
+}
+
+func (o *testOutput) Messages() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var messages []string
+	for _, batch := range o.batches {
+		for _, entry := range batch {
+			messages = append(messages, entry.Message)
+		}
+	}
+	return messages
+}
+
+func testEntries(messages ...string) []LogEntry {
+	var entries []LogEntry
+	for _, message := range messages {
+		entries = append(entries, LogEntry{Message: message})
+	}
+	return entries
+}
+
+func TestFanOutToOutputs(t *testing.T) {
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer s.Close()
+
+	a := &testOutput{name: "a"}
+	b := &testOutput{name: "b", failing: true}
+	workerB := NewOutputWorker(b, s.Metrics)
+	go s.Drain("a", NewOutputWorker(a, s.Metrics).Deliver)
+	go s.Drain("b", workerB.Deliver)
+
+	_, err := s.Write(MetadataValues{}, testEntries("one"))
+	assert.NoError(t, err)
+	_, err = s.Write(MetadataValues{}, testEntries("two"))
+	assert.NoError(t, err)
+
+	// b failing doesn't stop a from getting everything
+	waitFor(t, func() bool {
+		return len(a.Messages()) == 2
+	})
+	assert.Empty(t, b.Messages())
+
+	// and b's backlog stays spooled until it recovers
+	segments, err := s.Segments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 2)
+	assert.True(t, s.Metrics.ForOutput("b").UploadFailure.Count() > 0)
+	assert.Equal(t, int64(2), s.Metrics.ForOutput("a").UploadSuccess.Count())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+const (
+	// Entries read from the journal that can be waiting on the buffer manager
+	EntryQueueSize = 1000
+
+	// How often the buffer manager looks for buffers old enough to flush
+	FlushCheckInterval = time.Second
+
+	DefaultUploadWorkers = 4
+	DefaultUploadTimeout = 10 * time.Second
+
+	// Leaves a little of the default kubernetes grace period of 30s to exit in
+	DefaultShutdownTimeout = 25 * time.Second
+
+	// How often shutdown checks whether the outputs have caught up
+	ShutdownPollInterval = 100 * time.Millisecond
+)
+
+// Pipeline moves entries from the journal to the spool:
+//
+//	journal reader -> entry queue -> buffer manager -> spool -> upload workers
+//
+// The reader goroutine only reads, so it keeps going whatever the outputs are
+// doing. The buffer manager is the only goroutine that touches the LogBuffers:
+// it filters and buffers entries, and writes buffers to the spool when they are
+// ready. Uploading is left to the pool of workers draining the spool for each
+// output (see Spool.Drain), so a retrying upload never stops the journal being read.
+type Pipeline struct {
+	Reader               *JournalReader
+	Checkpoint           *Checkpoint
+	Spool                *Spool
+	Metrics              *Metrics
+	EventFilters         *FilterChain
+	FormatMessageFilters *FilterChain
+	ExcludeCategories    []string
+	Routes               RouteFn // nil sends everything to every output
+	Outputs              []Output
+
+	lastCursor   string
+	lastLoopTime time.Time
+}
+
+// Runs the pipeline, and any background outputs, until stop is closed. Anything still
+// buffered is left for Shutdown.
+func (p *Pipeline) Run(stop <-chan struct{}) {
+	var outputs sync.WaitGroup
+	defer outputs.Wait()
+	for _, output := range p.Outputs {
+		if o, ok := output.(BackgroundOutput); ok {
+			outputs.Add(1)
+			go func() {
+				defer outputs.Done()
+				o.Run(stop)
+			}()
+		}
+	}
+
+	entries := make(chan *sdjournal.JournalEntry, EntryQueueSize)
+	readerDone := make(chan struct{})
+	go func() {
+		p.readJournal(entries, stop)
+		close(readerDone)
+	}()
+	p.manageBuffers(entries, stop)
+	<-readerDone
+}
+
+func (p *Pipeline) readJournal(entries chan<- *sdjournal.JournalEntry, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		ent := p.Reader.GetNextEntry()
+		if ent == nil {
+			continue
+		}
+		select {
+		case entries <- ent:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *Pipeline) manageBuffers(entries <-chan *sdjournal.JournalEntry, stop <-chan struct{}) {
+	ticker := time.NewTicker(FlushCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.Metrics.MainLoopSpins.Inc(1)
+		if !p.lastLoopTime.IsZero() {
+			p.Metrics.MainLoopTime.UpdateSince(p.lastLoopTime)
+		}
+		p.lastLoopTime = time.Now()
+
+		select {
+		case <-stop:
+			return
+		case ent := <-entries:
+			p.handleEntry(ent)
+		case <-ticker.C:
+			p.flushBuffers()
+			p.Metrics.EntriesQueued.Update(int64(len(entries)))
+		}
+	}
+}
+
+func (p *Pipeline) handleEntry(ent *sdjournal.JournalEntry) {
+	seq := p.Checkpoint.Read(ent.Cursor)
+	defer func() {
+		p.lastCursor = ent.Cursor
+	}()
+
+	if ent.Cursor == p.lastCursor {
+		// Hrm, same cursor? Ok, skip it
+		p.Metrics.DebugSkippedCursor.Inc(1)
+		return
+	}
+	if !p.EventFilters.Want(ent) {
+		return
+	}
+
+	//by default just use the raw message
+	logMessage := ent.Fields["MESSAGE"]
+
+	//optionally, if the transport is configured to be formatted then use a formatted message instead
+	if p.FormatMessageFilters.Want(ent) {
+		logMessage = FormatLogEntry(ent)
+	}
+
+	//lookup correct buffer for entry
+	buf := getOrCreateActiveBufferForEntry(ent)
+	if p.Routes != nil {
+		buf = getOrCreateRoutedBuffer(ent, buf, p.Routes(ent))
+	}
+
+	//check whether category is excluded
+	if isSumoCategoryExcluded(buf.Metadata.category, p.ExcludeCategories) {
+		return
+	}
+
+	//pin the checkpoint until the buffer this entry starts has been spooled
+	if len(buf.Entries) == 0 {
+		buf.Seq = seq
+		p.Checkpoint.Hold(seq)
+	}
+	//append desired msg to that queue
+	buf.Append(NewLogEntry(ent, logMessage))
+	err := seenCursors.Add(ent.Cursor, nil, seenCursorExpiry)
+	if err != nil {
+		// Shouldn't happen!
+		log.Println("Error: processing previously seen cursor: ", ent.Cursor)
+		p.Metrics.DebugDupCursor.Inc(1)
+	}
+
+	//don't wait for the next tick if it's full
+	if buf.NeedsFlush() {
+		p.flush(buf)
+		p.Reader.SaveCursor(p.Checkpoint.Committed())
+	}
+}
+
+// Spools every buffer that is ready, then moves the state file forward. Buffers that
+// are empty and older than activeBufferExpiry are dropped, so ones for containers that
+// have gone don't pile up, and the metadata for the rest is looked up again. A buffer
+// is never dropped with entries in it, they would be lost and their hold on the
+// checkpoint never released.
+func (p *Pipeline) flushBuffers() {
+	activeBufferItems := activeBuffers.Items()
+	p.Metrics.BuffersActive.Update(int64(len(activeBufferItems)))
+
+	for id, item := range activeBufferItems {
+		buf := item.Object.(*LogBuffer)
+		if buf.NeedsFlush() {
+			p.flush(buf)
+		}
+		if len(buf.Entries) == 0 && time.Since(buf.Created) > activeBufferExpiry {
+			activeBuffers.Delete(id)
+		}
+	}
+
+	// Only now that flushed buffers are spooled is it safe to move the state file forward
+	p.Reader.SaveCursor(p.Checkpoint.Committed())
+}
+
+func (p *Pipeline) flush(buf *LogBuffer) {
+	_, err := p.Spool.Write(buf.Metadata, buf.GetEntries())
+	if err != nil {
+		log.Fatalln("Error writing to spool: ", err)
+	}
+	//safely on disk, so clear buffer and let the checkpoint move past it
+	seq := buf.Seq
+	buf.Clear()
+	p.Checkpoint.Release(seq)
+}
+
+// Stops the pipeline cleanly once Run has returned: flushes every buffer to the
+// spool in parallel, then waits until deadline for the outputs to deliver what is
+// spooled and for background outputs to flush. Returns the number of messages that
+// some output didn't get in time, they stay in the spool, or the output's staging,
+// and are sent on the next start.
+func (p *Pipeline) Shutdown(deadline time.Time) int {
+	var wg sync.WaitGroup
+	for _, item := range activeBuffers.Items() {
+		buf := item.Object.(*LogBuffer)
+		if len(buf.Entries) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.flush(buf)
+		}()
+	}
+	wg.Wait()
+	p.Reader.SaveCursor(p.Checkpoint.Committed())
+
+	for len(p.Spool.Undelivered()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(ShutdownPollInterval)
+	}
+
+	abandoned := 0
+	for _, segment := range p.Spool.Undelivered() {
+		_, entries, err := p.Spool.Read(segment)
+		if err == nil {
+			abandoned += len(entries)
+		}
+	}
+	for _, output := range p.Outputs {
+		if o, ok := output.(BackgroundOutput); ok {
+			abandoned += o.Flush(deadline)
+		}
+	}
+	return abandoned
+}
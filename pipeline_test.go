@@ -0,0 +1,237 @@
+package main
+
+import (
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPipeline struct {
+	*Pipeline
+	dir           string
+	stateFilePath string
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// Runs a pipeline over a fake journal with messages big enough that every 101
+// entries fill a buffer, so it flushes without waiting on MaxBufferAge.
+func runTestPipeline(t *testing.T, n int, outputs ...*testOutput) *testPipeline {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	tp := &testPipeline{
+		dir:           dir,
+		stateFilePath: filepath.Join(dir, DefaultStateFile),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	metrics := &Metrics{}
+	metrics.Init()
+	var names []string
+	for _, o := range outputs {
+		names = append(names, o.Name())
+	}
+	spool, err := OpenSpool(filepath.Join(dir, DefaultSpoolDir), 1024*1024*1024, names, metrics)
+	assert.NoError(t, err)
+	for _, o := range outputs {
+		for i := 0; i < 3; i++ {
+			go spool.Drain(o.Name(), NewOutputWorker(o, metrics).Deliver)
+		}
+	}
+
+	j := newFakeJournal(n)
+	for _, e := range j.entries {
+		e.Fields["MESSAGE"] = padMessage(e.Fields["MESSAGE"])
+	}
+	activeBuffers.Flush()
+	seenCursors.Flush()
+	jr := openFakeJournal(t, j, tp.stateFilePath)
+	rawMessages := &FilterChain{}
+	rawMessages.AddFilter(func(e *sdjournal.JournalEntry) bool {
+		return false
+	})
+	tp.Pipeline = &Pipeline{
+		Reader:               jr,
+		Checkpoint:           NewCheckpoint(jr.Cursor),
+		Spool:                spool,
+		Metrics:              metrics,
+		EventFilters:         &FilterChain{},
+		FormatMessageFilters: rawMessages,
+	}
+
+	go func() {
+		tp.Run(tp.stop)
+		close(tp.done)
+	}()
+	return tp
+}
+
+func (tp *testPipeline) Stop() {
+	select {
+	case <-tp.stop:
+	default:
+		close(tp.stop)
+	}
+	<-tp.done
+}
+
+func (tp *testPipeline) Close() {
+	tp.Stop()
+	tp.Spool.Close()
+	os.RemoveAll(tp.dir)
+}
+
+func (tp *testPipeline) State() string {
+	b, _ := ioutil.ReadFile(tp.stateFilePath)
+	return string(b)
+}
+
+// Waits for the buffer manager to have taken the entry at cursor
+func (tp *testPipeline) WaitForCursor(t *testing.T, cursor string) {
+	waitFor(t, func() bool {
+		_, found := seenCursors.Get(cursor)
+		return found
+	})
+}
+
+func padMessage(message string) string {
+	return message + strings.Repeat(" ", 1024-len(message))
+}
+
+func padMessages(n int) []string {
+	var messages []string
+	for _, e := range newFakeJournal(n).entries {
+		messages = append(messages, padMessage(e.Fields["MESSAGE"]))
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+func TestPipelineDelivers(t *testing.T) {
+	o := &testOutput{}
+	tp := runTestPipeline(t, 303, o)
+	defer tp.Close()
+
+	waitFor(t, func() bool {
+		return len(o.Messages()) == 303
+	})
+	got := o.Messages()
+	sort.Strings(got)
+	assert.Equal(t, padMessages(303), got)
+
+	waitFor(t, func() bool {
+		return tp.State() == "s=test;i=303"
+	})
+}
+
+func TestPipelineKeepsReadingWhileUploadsFail(t *testing.T) {
+	o := &testOutput{failing: true}
+	tp := runTestPipeline(t, 303, o)
+	defer tp.Close()
+
+	// Nothing gets uploaded, but the journal is still read and spooled
+	waitFor(t, func() bool {
+		return tp.State() == "s=test;i=303"
+	})
+	segments, err := tp.Spool.Segments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 3)
+	assert.Empty(t, o.Messages())
+}
+
+func TestPipelineShutdownFlushesBuffers(t *testing.T) {
+	o := &testOutput{}
+	tp := runTestPipeline(t, 5, o)
+	defer tp.Close()
+
+	// Nowhere near full, so without a shutdown these would sit in their buffer
+	tp.WaitForCursor(t, "s=test;i=5")
+	tp.Stop()
+	assert.Empty(t, o.Messages())
+
+	assert.Equal(t, 0, tp.Shutdown(time.Now().Add(5*time.Second)))
+	got := o.Messages()
+	sort.Strings(got)
+	assert.Equal(t, padMessages(5), got)
+	assert.Equal(t, "s=test;i=5", tp.State())
+}
+
+func TestPipelineShutdownDeadline(t *testing.T) {
+	o := &testOutput{failing: true}
+	tp := runTestPipeline(t, 5, o)
+	defer tp.Close()
+
+	tp.WaitForCursor(t, "s=test;i=5")
+	tp.Stop()
+
+	start := time.Now()
+	assert.Equal(t, 5, tp.Shutdown(start.Add(200*time.Millisecond)))
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	// What was abandoned is still spooled, so the checkpoint can move past it
+	assert.Equal(t, "s=test;i=5", tp.State())
+	segments, err := tp.Spool.Segments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestPipelineDropsOldBuffersOnlyWhenEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer s.Close()
+
+	activeBuffers.Flush()
+	seenCursors.Flush()
+	j := newFakeJournal(2)
+	jr := openFakeJournal(t, j, filepath.Join(dir, DefaultStateFile))
+	p := &Pipeline{
+		Reader:               jr,
+		Checkpoint:           NewCheckpoint(jr.Cursor),
+		Spool:                s,
+		Metrics:              s.Metrics,
+		EventFilters:         &FilterChain{},
+		FormatMessageFilters: &FilterChain{},
+	}
+	p.handleEntry(j.entries[0])
+	p.handleEntry(j.entries[1])
+	assert.Equal(t, 1, activeBuffers.ItemCount())
+	buf := getOrCreateActiveBufferForEntry(j.entries[0])
+
+	// Past its expiry, but it still has entries that aren't due to be flushed
+	buf.Created = time.Now().Add(-activeBufferExpiry - time.Minute)
+	p.flushBuffers()
+	assert.Equal(t, 1, activeBuffers.ItemCount())
+	assert.Equal(t, "", p.Checkpoint.Committed())
+
+	// Once they're spooled it goes, and the checkpoint moves on
+	buf.Age = time.Now().Add(-MaxBufferAge - time.Second)
+	p.flushBuffers()
+	assert.Equal(t, 0, activeBuffers.ItemCount())
+	assert.Equal(t, "s=test;i=2", p.Checkpoint.Committed())
+	segments, err := s.Segments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestSystemdUnitsGetTheirOwnBuffers(t *testing.T) {
+	entry := func(identifier string, unit string) *sdjournal.JournalEntry {
+		return &sdjournal.JournalEntry{Fields: map[string]string{
+			"_SYSTEMD_SLICE":    "system.slice",
+			"SYSLOG_IDENTIFIER": identifier,
+			"_SYSTEMD_UNIT":     unit,
+		}}
+	}
+	// e.g sshd logs as sshd from both its listener and per connection units
+	assert.Equal(t, getLogBufferIdentifierForEntry(entry("sshd", "sshd.service")), getLogBufferIdentifierForEntry(entry("sshd", "sshd.service")))
+	assert.NotEqual(t, getLogBufferIdentifierForEntry(entry("sshd", "sshd.service")), getLogBufferIdentifierForEntry(entry("sshd", "sshd@1.service")))
+}
@@ -12,20 +12,17 @@ type PodList struct {
 
 type Pod struct {
 	Metadata struct {
-		Name              string    `json:"name"`
-		GenerateName      string    `json:"generateName"`
-		Namespace         string    `json:"namespace"`
-		SelfLink          string    `json:"selfLink"`
-		UID               string    `json:"uid"`
-		ResourceVersion   string    `json:"resourceVersion"`
-		CreationTimestamp time.Time `json:"creationTimestamp"`
-		Labels            struct {
-			ControllerRevisionHash string `json:"controller-revision-hash"`
-			K8SApp                 string `json:"k8s-app"`
-			PodTemplateGeneration  string `json:"pod-template-generation"`
-		} `json:"labels"`
-		Annotations struct {
+		Name              string            `json:"name"`
+		GenerateName      string            `json:"generateName"`
+		Namespace         string            `json:"namespace"`
+		SelfLink          string            `json:"selfLink"`
+		UID               string            `json:"uid"`
+		ResourceVersion   string            `json:"resourceVersion"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+		Labels            map[string]string `json:"labels"`
+		Annotations       struct {
 			SumologicTrustedTimestamp string `json:"sumologic.com/trustedTimestamp"`
+			SumologicCollector        string `json:"com.sumologic/collector"`
 		} `json:"annotations"`
 		OwnerReferences []struct {
 			APIVersion         string `json:"apiVersion"`
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	DefaultPrometheusAddr = ":9180"
+	prometheusNamespace   = "log_forwarder_"
+)
+
+// Quantiles reported for timers and histograms, which are exposed as summaries
+var prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+var prometheusInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// Serves everything in registry in the Prometheus text exposition format.
+// See: https://prometheus.io/docs/instrumenting/exposition_formats/
+func PrometheusHandler(registry metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write(WritePrometheusMetrics(registry))
+	})
+}
+
+func WritePrometheusMetrics(registry metrics.Registry) []byte {
+	//sort so the output is stable, the registry is a map
+	all := map[string]interface{}{}
+	var names []string
+	registry.Each(func(name string, i interface{}) {
+		all[name] = i
+		names = append(names, name)
+	})
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		promName := prometheusName(name)
+		switch m := all[name].(type) {
+		case metrics.Counter:
+			writePrometheusValue(&b, promName, "counter", float64(m.Count()))
+		case metrics.Meter:
+			writePrometheusValue(&b, promName, "counter", float64(m.Count()))
+		case metrics.Gauge:
+			writePrometheusValue(&b, promName, "gauge", float64(m.Value()))
+		case metrics.GaugeFloat64:
+			writePrometheusValue(&b, promName, "gauge", m.Value())
+		case metrics.Timer:
+			// Timers are in nanoseconds, prometheus wants seconds
+			t := m.Snapshot()
+			promName = strings.TrimSuffix(promName, "_ms") + "_seconds"
+			writePrometheusSummary(&b, promName, t.Percentiles(prometheusQuantiles), float64(t.Sum())/1e9, t.Count(), 1e-9)
+		case metrics.Histogram:
+			h := m.Snapshot()
+			writePrometheusSummary(&b, promName, h.Percentiles(prometheusQuantiles), float64(h.Sum()), h.Count(), 1)
+		}
+	}
+	return b.Bytes()
+}
+
+func writePrometheusValue(b *bytes.Buffer, name string, kind string, value float64) {
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(b, "%s %v\n", name, value)
+}
+
+func writePrometheusSummary(b *bytes.Buffer, name string, quantiles []float64, sum float64, count int64, scale float64) {
+	fmt.Fprintf(b, "# TYPE %s summary\n", name)
+	for i, q := range prometheusQuantiles {
+		fmt.Fprintf(b, "%s{quantile=\"%v\"} %v\n", name, q, quantiles[i]*scale)
+	}
+	fmt.Fprintf(b, "%s_sum %v\n", name, sum)
+	fmt.Fprintf(b, "%s_count %d\n", name, count)
+}
+
+// e.g: "buffers.upload.success" -> "log_forwarder_buffers_upload_success"
+func prometheusName(name string) string {
+	return prometheusNamespace + prometheusInvalidChars.ReplaceAllString(name, "_")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestPrometheusName(t *testing.T) {
+	assert.Equal(t, "log_forwarder_buffers_upload_success", prometheusName("buffers.upload.success"))
+	assert.Equal(t, "log_forwarder_runtime_MemStats_Alloc", prometheusName("runtime.MemStats.Alloc"))
+}
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("upload.messages.count", registry).Inc(3)
+	metrics.GetOrRegisterGauge("buffers.active.gauge", registry).Update(7)
+	metrics.GetOrRegisterGaugeFloat64("runtime.MemStats.GCCPUFraction", registry).Update(0.5)
+	timer := metrics.GetOrRegisterTimer("upload.time_ms", registry)
+	timer.Update(2 * time.Second)
+	timer.Update(4 * time.Second)
+
+	out := string(WritePrometheusMetrics(registry))
+	assert.Contains(t, out, "# TYPE log_forwarder_upload_messages_count counter\nlog_forwarder_upload_messages_count 3\n")
+	assert.Contains(t, out, "# TYPE log_forwarder_buffers_active_gauge gauge\nlog_forwarder_buffers_active_gauge 7\n")
+	assert.Contains(t, out, "log_forwarder_runtime_MemStats_GCCPUFraction 0.5\n")
+	assert.Contains(t, out, "# TYPE log_forwarder_upload_time_seconds summary\n")
+	assert.Contains(t, out, "log_forwarder_upload_time_seconds{quantile=\"0.99\"} 4\n")
+	assert.Contains(t, out, "log_forwarder_upload_time_seconds_sum 6\n")
+	assert.Contains(t, out, "log_forwarder_upload_time_seconds_count 2\n")
+}
+
+func TestPrometheusHandlerServesRuntimeStats(t *testing.T) {
+	m := &Metrics{}
+	m.Init()
+	metrics.CaptureRuntimeMemStatsOnce(m.Registry)
+
+	srv := httptest.NewServer(PrometheusHandler(m.Registry))
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	assert.Contains(t, string(body), "log_forwarder_runtime_MemStats_HeapAlloc ")
+	assert.Contains(t, string(body), "log_forwarder_buffers_upload_success 0\n")
+}
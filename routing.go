@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// Routing rules are loaded from a JSON file, e.g:
+//
+//	{
+//	  "default": ["sumo", "s3"],
+//	  "rules": [
+//	    {"to": ["sumo:soc"], "match": [{"field": "_TRANSPORT", "equals": "audit"}]},
+//	    {"to": ["sumo:soc", "s3"], "match": [{"metadata": "namespace", "equals": "security"}]},
+//	    {"to": ["s3"], "match": [{"field": "_SYSTEMD_UNIT", "glob": "kubelet*"}]}
+//	  ]
+//	}
+//
+// Rules are tried in order and the first one whose conditions all match decides
+// where an entry goes, with the same conditions as filter rules. If no rule matches
+// the default applies, and if there is no default the entry goes to every output.
+//
+// Each destination is an output, or <output>:<collector> for one of an output's
+// named collectors (see CollectorOutput), e.g. sumo:soc for SUMO_COLLECTOR_URL_SOC.
+// An entry only goes to the outputs it is routed to.
+type RoutingRules struct {
+	Default []string      `json:"default"`
+	Rules   []RoutingRule `json:"rules"`
+}
+
+type RoutingRule struct {
+	To    []string          `json:"to"`
+	Match []FilterCondition `json:"match"`
+}
+
+// Returns the destinations for an entry, nil for every output
+type RouteFn func(e *sdjournal.JournalEntry) []string
+
+// Outputs that can send to one of several named collectors implement this, so
+// that routes can name them
+type CollectorOutput interface {
+	HasCollector(name string) bool
+}
+
+func LoadRoutingRules(path string) (*RoutingRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules RoutingRules
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &rules, nil
+}
+
+// Compiles the rules to a RouteFn, checking that every destination is one of outputs.
+// lookup is only called for rules that match on metadata.
+func (rs *RoutingRules) Compile(lookup MetadataLookup, outputs []Output) (RouteFn, error) {
+	var defaultRoute []string
+	if len(rs.Default) > 0 {
+		err := checkRoute(rs.Default, outputs)
+		if err != nil {
+			return nil, fmt.Errorf("default: %s", err)
+		}
+		defaultRoute = rs.Default
+	}
+
+	type compiledRule struct {
+		to    []string
+		match []func(e *sdjournal.JournalEntry) bool
+	}
+	var compiled []compiledRule
+	for i, rule := range rs.Rules {
+		if len(rule.To) == 0 {
+			return nil, fmt.Errorf("rule %d: needs somewhere to route to, use a filter rule to drop entries", i+1)
+		}
+		err := checkRoute(rule.To, outputs)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		cr := compiledRule{to: rule.To}
+		for _, cond := range rule.Match {
+			fn, err := cond.compile(lookup)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+			cr.match = append(cr.match, fn)
+		}
+		compiled = append(compiled, cr)
+	}
+
+	return func(e *sdjournal.JournalEntry) []string {
+	NextRule:
+		for _, rule := range compiled {
+			for _, fn := range rule.match {
+				if !fn(e) {
+					continue NextRule
+				}
+			}
+			return rule.to
+		}
+		return defaultRoute
+	}, nil
+}
+
+// Checks every destination is an output, or one of its collectors, and that no
+// output is named twice, as a batch can only go to one of its collectors
+func checkRoute(route []string, outputs []Output) error {
+	seen := map[string]bool{}
+	for _, dest := range route {
+		name, collector := splitDestination(dest)
+		if seen[name] {
+			return fmt.Errorf("route names output %q more than once", name)
+		}
+		seen[name] = true
+
+		var output Output
+		for _, o := range outputs {
+			if o.Name() == name {
+				output = o
+			}
+		}
+		if output == nil {
+			return fmt.Errorf("route to %q, which isn't one of the outputs", dest)
+		}
+		if collector == "" {
+			continue
+		}
+		c, ok := output.(CollectorOutput)
+		if !ok || !c.HasCollector(collector) {
+			return fmt.Errorf("route to %q, output %s has no collector named %q", dest, name, collector)
+		}
+	}
+	return nil
+}
+
+// Splits <output>:<collector>, the collector is empty if there isn't one
+func splitDestination(dest string) (string, string) {
+	i := strings.Index(dest, ":")
+	if i < 0 {
+		return dest, ""
+	}
+	return dest[:i], dest[i+1:]
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func loadTestRoutingRules(t *testing.T, rulesJSON string) *RoutingRules {
+	f, err := ioutil.TempFile("", "routing-rules")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(rulesJSON)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	rules, err := LoadRoutingRules(f.Name())
+	assert.NoError(t, err)
+	return rules
+}
+
+func testRoutingOutputs() []Output {
+	sumo := newTestSumoUploader("http://localhost")
+	sumo.Collectors = map[string]string{"soc": "http://localhost/soc"}
+	return []Output{sumo, &testOutput{name: "s3"}}
+}
+
+func compileTestRoutingRules(t *testing.T, rulesJSON string) RouteFn {
+	fn, err := loadTestRoutingRules(t, rulesJSON).Compile(func(e *sdjournal.JournalEntry) MetadataValues {
+		if e.Fields["_TRANSPORT"] == "kernel" {
+			return MetadataValues{category: "base/kubernetes/security/kernel", namespace: "security"}
+		}
+		return MetadataValues{category: "base/journald/journal"}
+	}, testRoutingOutputs())
+	assert.NoError(t, err)
+	return fn
+}
+
+func TestRoutingRulesDefault(t *testing.T) {
+	fn := compileTestRoutingRules(t, `{"rules": []}`)
+	assert.Nil(t, fn(&msg1))
+
+	fn = compileTestRoutingRules(t, `{"default": ["s3"], "rules": []}`)
+	assert.Equal(t, []string{"s3"}, fn(&msg1))
+}
+
+func TestRoutingRulesFirstMatchWins(t *testing.T) {
+	fn := compileTestRoutingRules(t, `{
+		"default": ["sumo"],
+		"rules": [
+			{"to": ["s3"], "match": [{"field": "_SYSTEMD_UNIT", "equals": "test.service"}]},
+			{"to": ["sumo:soc", "s3"], "match": [{"metadata": "namespace", "equals": "security"}]}
+		]
+	}`)
+	assert.Equal(t, []string{"sumo:soc", "s3"}, fn(&msg1))
+	assert.Equal(t, []string{"sumo"}, fn(&msg2)) // no rule matches, default
+	assert.Equal(t, []string{"s3"}, fn(&msg3))   // security, but the unit rule comes first
+}
+
+func TestRoutingRulesErrors(t *testing.T) {
+	for _, rulesJSON := range []string{
+		`{"default": ["loki"]}`,
+		`{"rules": [{"to": ["sumo:nope"], "match": []}]}`,
+		`{"rules": [{"to": ["s3:soc"], "match": []}]}`,
+		`{"rules": [{"to": ["sumo", "sumo:soc"], "match": []}]}`,
+		`{"rules": [{"to": [], "match": []}]}`,
+		`{"rules": [{"to": ["s3"], "match": [{"field": "PRIORITY"}]}]}`,
+	} {
+		_, err := loadTestRoutingRules(t, rulesJSON).Compile(nil, testRoutingOutputs())
+		assert.Error(t, err, rulesJSON)
+	}
+}
+
+func TestRouteTo(t *testing.T) {
+	routed, collector := MetadataValues{}.routeTo("sumo")
+	assert.True(t, routed)
+	assert.Equal(t, "", collector)
+
+	metadata := MetadataValues{routes: []string{"sumo:soc", "s3"}}
+	routed, collector = metadata.routeTo("sumo")
+	assert.True(t, routed)
+	assert.Equal(t, "soc", collector)
+	routed, collector = metadata.routeTo("s3")
+	assert.True(t, routed)
+	assert.Equal(t, "", collector)
+	routed, _ = metadata.routeTo("loki")
+	assert.False(t, routed)
+}
+
+func TestRoutedDelivery(t *testing.T) {
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer s.Close()
+
+	a := &testOutput{name: "a"}
+	b := &testOutput{name: "b"}
+	go s.Drain("a", NewOutputWorker(a, s.Metrics).Deliver)
+	go s.Drain("b", NewOutputWorker(b, s.Metrics).Deliver)
+
+	_, err := s.Write(MetadataValues{routes: []string{"b"}}, testEntries("one"))
+	assert.NoError(t, err)
+	_, err = s.Write(MetadataValues{}, testEntries("two"))
+	assert.NoError(t, err)
+
+	waitFor(t, func() bool {
+		return len(b.Messages()) == 2
+	})
+	waitFor(t, func() bool {
+		segments, err := s.Segments()
+		return err == nil && len(segments) == 0
+	})
+	assert.Equal(t, []string{"two"}, a.Messages())
+	assert.Equal(t, []string{"one", "two"}, b.Messages())
+}
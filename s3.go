@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultS3StagingDir    = "s3staging"
+	DefaultS3MaxObjectMB   = 64
+	DefaultS3MaxObjectAge  = time.Hour
+	DefaultS3MaxStagingMB  = 1024
+	DefaultS3PartSizeMB    = 8 // S3's minimum is 5
+	DefaultS3UploadTimeout = 10 * time.Minute
+	S3UploadCheckInterval  = time.Minute
+	s3CurrentObject        = "current"
+	s3PendingDir           = "pending"
+	s3RejectedDir          = "rejected"
+	s3ObjectSuffix         = ".ndjson.gz"
+	s3ObjectMetadataSuffix = ".json"
+)
+
+// S3Output archives entries to S3, or anything compatible, as gzipped NDJSON objects
+// with keys like <Prefix><category>/yyyy/mm/dd/<host>-<first cursor>.ndjson.gz.
+//
+// Batches are accumulated per category in StagingDir, so Send only has to append
+// them to a file, and they are safe there across restarts. Once a category's object
+// reaches MaxObjectBytes or MaxObjectAge it moves to the pending directory, to be
+// uploaded by Run, with a multipart upload if it is bigger than PartSize. An object
+// that S3 rejects outright is kept in the rejected directory rather than retried.
+// On shutdown, Flush uploads everything staged, whatever its age.
+//
+// Staging is capped at MaxStagingBytes. When it is full Send fails, leaving batches
+// in the spool until uploads catch up, as staged objects are already checkpointed.
+type S3Output struct {
+	Client          *S3Client
+	Prefix          string
+	StagingDir      string
+	MaxObjectBytes  int64
+	MaxObjectAge    time.Duration
+	MaxStagingBytes int64 // no limit if zero
+	PartSize        int
+	UploadTimeout   time.Duration // for each object
+
+	mu  sync.Mutex // guards the current objects
+	now func() time.Time
+}
+
+// Kept alongside each object
+type s3ObjectMetadata struct {
+	Key     string    `json:"key"`
+	Started time.Time `json:"started"`
+	Entries int       `json:"entries"`
+	Size    int64     `json:"size"` // of the batches all written, anything after is cut off
+}
+
+func (s3 *S3Output) Name() string {
+	return "s3"
+}
+
+func (s3 *S3Output) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var lines bytes.Buffer
+	enc := json.NewEncoder(&lines)
+	for _, entry := range batch {
+		err := enc.Encode(newJSONRecord(metadata, entry))
+		if err != nil {
+			return err
+		}
+	}
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	dir := filepath.Join(s3.StagingDir, url.PathEscape(metadata.category))
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return err
+	}
+	err = s3.checkStagingCap()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, s3CurrentObject)
+	var object s3ObjectMetadata
+	err = readJSONFile(path+s3ObjectMetadataSuffix, &object)
+	if os.IsNotExist(err) {
+		object = s3ObjectMetadata{
+			Key:     s3.key(metadata, batch[0]),
+			Started: s3.time(),
+		}
+		// Left by a seal we stopped in the middle of, which is all written
+		if info, err := os.Stat(path + s3ObjectSuffix); err == nil {
+			object.Size = info.Size()
+		}
+		// Where the batch starts goes down before it does, so if we stop part way
+		// through it the next go cuts off what there is of it
+		err = writeJSONFile(path+s3ObjectMetadataSuffix, object)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// Each batch is a gzip member, which together are one gzip stream
+	f, err := os.OpenFile(path+s3ObjectSuffix, os.O_WRONLY|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(object.Size)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	n, err := f.WriteAt(compress(lines.String()), object.Size)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	object.Entries += len(batch)
+	object.Size += int64(n)
+	err = writeJSONFile(path+s3ObjectMetadataSuffix, object)
+	if err != nil {
+		return err
+	}
+	return s3.seal(dir, false)
+}
+
+// <Prefix><category>/yyyy/mm/dd/<host>-<cursor>.ndjson.gz
+func (s3 *S3Output) key(metadata MetadataValues, first LogEntry) string {
+	return s3.Prefix + strings.Trim(metadata.category, "/") + "/" +
+		entryTime(first).Format("2006/01/02") + "/" +
+		metadata.host + "-" + first.Cursor + s3ObjectSuffix
+}
+
+func (s3 *S3Output) time() time.Time {
+	if s3.now != nil {
+		return s3.now()
+	}
+	return time.Now()
+}
+
+// Moves a category's current object to pending if it's big or old enough, or if
+// force, whatever it is. The caller holds s3.mu.
+func (s3 *S3Output) seal(dir string, force bool) error {
+	path := filepath.Join(dir, s3CurrentObject)
+	var metadata s3ObjectMetadata
+	err := readJSONFile(path+s3ObjectMetadataSuffix, &metadata)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := os.Stat(path + s3ObjectSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() > metadata.Size {
+		// We stopped part way through a batch, which is still in the spool
+		err = os.Truncate(path+s3ObjectSuffix, metadata.Size)
+		if err != nil {
+			return err
+		}
+	}
+	big := s3.MaxObjectBytes > 0 && metadata.Size >= s3.MaxObjectBytes
+	old := s3.MaxObjectAge > 0 && s3.time().Sub(metadata.Started) >= s3.MaxObjectAge
+	if !big && !old && !force {
+		return nil
+	}
+
+	pending := filepath.Join(s3.StagingDir, s3PendingDir)
+	err = os.MkdirAll(pending, os.FileMode(0700))
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum([]byte(metadata.Key + metadata.Started.String()))
+	name := filepath.Join(pending, hex.EncodeToString(sum[:]))
+	// The metadata first, so if we stop in between the object is left where the next
+	// batch will add to it, rather than pending without a key
+	err = os.Rename(path+s3ObjectMetadataSuffix, name+s3ObjectMetadataSuffix)
+	if err == nil {
+		err = os.Rename(path+s3ObjectSuffix, name+s3ObjectSuffix)
+	}
+	return err
+}
+
+// Uploads objects as they are due, until stop is closed
+func (s3 *S3Output) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(S3UploadCheckInterval)
+	defer ticker.Stop()
+	for {
+		s3.sealAll(false)
+		s3.UploadPending(stop)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Seals every category's current object that is old enough, or all of them if force
+func (s3 *S3Output) sealAll(force bool) {
+	dirs, err := ioutil.ReadDir(s3.StagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("s3: Error listing staged objects: ", err)
+	}
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == s3PendingDir || dir.Name() == s3RejectedDir {
+			continue
+		}
+		err := s3.seal(filepath.Join(s3.StagingDir, dir.Name()), force)
+		if err != nil {
+			log.Println("s3: Error sealing object: ", err)
+		}
+	}
+}
+
+// Seals and uploads everything staged, giving up at deadline. Returns the number of
+// entries left staged, which are uploaded after the next start. Run must have returned.
+func (s3 *S3Output) Flush(deadline time.Time) int {
+	s3.sealAll(true)
+	stop := make(chan struct{})
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		close(stop)
+	})
+	defer timer.Stop()
+	s3.UploadPending(stop)
+
+	left := 0
+	objects, _ := filepath.Glob(filepath.Join(s3.StagingDir, "*", "*"+s3ObjectMetadataSuffix))
+	for _, path := range objects {
+		if filepath.Base(filepath.Dir(path)) == s3RejectedDir {
+			continue
+		}
+		var metadata s3ObjectMetadata
+		if readJSONFile(path, &metadata) == nil {
+			left += metadata.Entries
+		}
+	}
+	return left
+}
+
+// Uploads every pending object, stopping at the first that fails, to try again later
+func (s3 *S3Output) UploadPending(stop <-chan struct{}) {
+	pending := filepath.Join(s3.StagingDir, s3PendingDir)
+	files, err := ioutil.ReadDir(pending)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("s3: Error listing pending objects: ", err)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), s3ObjectMetadataSuffix) {
+			continue
+		}
+		name := filepath.Join(pending, strings.TrimSuffix(f.Name(), s3ObjectMetadataSuffix))
+		err := s3.upload(name, stop)
+		switch err.(type) {
+		case nil:
+			health.Recover("output s3")
+			_ = os.Remove(name + s3ObjectSuffix)
+			_ = os.Remove(name + s3ObjectMetadataSuffix)
+			continue
+		case *RejectedError:
+			health.Recover("output s3")
+			log.Println("s3: Object rejected, keeping it in the rejected directory: ", err)
+			s3.reject(name)
+			continue
+		case *UnauthorizedError:
+			health.Fail("output s3", err.Error())
+			log.Printf("s3: ERROR: %s. Check the configured endpoint and credentials, nothing will be archived until they're fixed!", err)
+		default:
+			log.Println("s3: Error uploading object, will try again: ", err)
+		}
+		return
+	}
+}
+
+func (s3 *S3Output) upload(name string, stop <-chan struct{}) error {
+	var metadata s3ObjectMetadata
+	err := readJSONFile(name+s3ObjectMetadataSuffix, &metadata)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(name + s3ObjectSuffix)
+	if os.IsNotExist(err) {
+		// We stopped while sealing it, there's nothing to upload
+		return os.Remove(name + s3ObjectMetadataSuffix)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	timeout := s3.UploadTimeout
+	if timeout <= 0 {
+		timeout = DefaultS3UploadTimeout
+	}
+	partSize := s3.PartSize
+	if partSize <= 0 {
+		partSize = DefaultS3PartSizeMB * 1024 * 1024
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if info.Size() <= int64(partSize) {
+		body, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return s3.Client.PutObject(ctx, metadata.Key, body)
+	}
+
+	uploadID, err := s3.Client.CreateMultipartUpload(ctx, metadata.Key)
+	if err != nil {
+		return err
+	}
+	var etags []string
+	part := make([]byte, partSize)
+	for {
+		n, err := io.ReadFull(f, part)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			s3.abort(metadata.Key, uploadID)
+			return err
+		}
+		etag, err := s3.Client.UploadPart(ctx, metadata.Key, uploadID, len(etags)+1, part[:n])
+		if err != nil {
+			s3.abort(metadata.Key, uploadID)
+			return err
+		}
+		etags = append(etags, etag)
+	}
+	err = s3.Client.CompleteMultipartUpload(ctx, metadata.Key, uploadID, etags)
+	if err != nil {
+		s3.abort(metadata.Key, uploadID)
+	}
+	return err
+}
+
+// Best effort, so the parts already uploaded don't hang around. A bucket lifecycle
+// rule for incomplete multipart uploads catches any that are missed.
+func (s3 *S3Output) abort(key string, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := s3.Client.AbortMultipartUpload(ctx, key, uploadID)
+	if err != nil {
+		log.Println("s3: Error aborting multipart upload: ", err)
+	}
+}
+
+func (s3 *S3Output) reject(name string) {
+	rejected := filepath.Join(s3.StagingDir, s3RejectedDir)
+	err := os.MkdirAll(rejected, os.FileMode(0700))
+	if err == nil {
+		err = os.Rename(name+s3ObjectSuffix, filepath.Join(rejected, filepath.Base(name)+s3ObjectSuffix))
+	}
+	if err == nil {
+		err = os.Rename(name+s3ObjectMetadataSuffix, filepath.Join(rejected, filepath.Base(name)+s3ObjectMetadataSuffix))
+	}
+	if err != nil {
+		log.Println("s3: Error moving rejected object: ", err)
+	}
+}
+
+// Returns an error if staging is over MaxStagingBytes. Nothing staged is ever
+// dropped, as it has already been checkpointed. The caller holds s3.mu.
+func (s3 *S3Output) checkStagingCap() error {
+	if s3.MaxStagingBytes <= 0 {
+		return nil
+	}
+	var total int64
+	_ = filepath.Walk(s3.StagingDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if total > s3.MaxStagingBytes {
+		return fmt.Errorf("s3 staging is over its limit of %d bytes, waiting on uploads", s3.MaxStagingBytes)
+	}
+	return nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", data, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Client is just enough of the S3 API to upload objects, signed with AWS
+// Signature Version 4. Buckets are addressed by path, e.g. <Endpoint>/<Bucket>/<key>,
+// which works with AWS as well as MinIO and other S3-compatible stores.
+// See: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+type S3Client struct {
+	httpClient   *http.Client
+	Endpoint     string // e.g https://s3.us-east-1.amazonaws.com
+	Region       string
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials
+
+	now func() time.Time
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s3 *S3Client) PutObject(ctx context.Context, key string, body []byte) error {
+	_, _, err := s3.do(ctx, "PUT", key, nil, body)
+	return err
+}
+
+// Starts a multipart upload, returning its id
+func (s3 *S3Client) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	_, body, err := s3.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result s3InitiateMultipartUploadResult
+	err = xml.Unmarshal(body, &result)
+	if err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("unexpected response to create multipart upload: %s", truncate(string(body), 200))
+	}
+	return result.UploadID, nil
+}
+
+// Uploads part n, from 1, of a multipart upload. Returns the part's ETag.
+func (s3 *S3Client) UploadPart(ctx context.Context, key string, uploadID string, n int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(n)}, "uploadId": {uploadID}}
+	resp, _, err := s3.do(ctx, "PUT", key, query, body)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s3 *S3Client) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, etags []string) error {
+	complete := s3CompleteMultipartUpload{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, respBody, err := s3.do(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	// Completing can fail after the 200 has been sent, in which case the body says so
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete multipart upload: %s", truncate(string(respBody), 200))
+	}
+	return nil
+}
+
+func (s3 *S3Client) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	_, _, err := s3.do(ctx, "DELETE", key, url.Values{"uploadId": {uploadID}}, nil)
+	return err
+}
+
+// Makes a signed request, returning the response and its body, or an error
+// classified by HTTPResponseError
+func (s3 *S3Client) do(ctx context.Context, method string, key string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	u, err := url.Parse(strings.TrimSuffix(s3.Endpoint, "/") + "/" + s3.Bucket + "/" + s3URIEncode(key, false))
+	if err != nil {
+		return nil, nil, err
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	s3.sign(req, body)
+
+	resp, err := s3.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading s3 response: %s", err)
+	}
+	err = HTTPResponseError(resp, respBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// Adds the SigV4 Authorization header, signing the host and every header already set
+func (s3 *S3Client) sign(req *http.Request, body []byte) {
+	now := time.Now
+	if s3.now != nil {
+		now = s3.now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s3.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s3.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s3.SecretKey), date)
+	key = hmacSHA256(key, s3.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Percent encodes everything but the unreserved characters, and / unless encodeSlash
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Query parameters sorted by name, encoded the way SigV4 wants
+func s3CanonicalQuery(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3URIEncode(name, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
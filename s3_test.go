@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testS3 is a stand in for an S3-compatible store, like MinIO, that checks each
+// request's signature
+type testS3 struct {
+	*httptest.Server
+	client *S3Client
+
+	mu       sync.Mutex
+	statuses []int // to respond with, before handling requests properly
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	requests []string
+}
+
+func newTestS3(t *testing.T) *testS3 {
+	s := &testS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests = append(s.requests, r.Method+" "+r.URL.RawQuery)
+
+		if !s.validSignature(r, body) {
+			w.WriteHeader(403)
+			fmt.Fprint(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>")
+			return
+		}
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		query := r.URL.Query()
+		uploadID := query.Get("uploadId")
+		switch {
+		case r.Method == "PUT" && uploadID == "":
+			s.objects[key] = body
+		case r.Method == "POST" && query["uploads"] != nil:
+			uploadID = fmt.Sprint("upload-", len(s.uploads))
+			s.uploads[uploadID] = map[int][]byte{}
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadID)
+		case r.Method == "PUT":
+			var n int
+			fmt.Sscan(query.Get("partNumber"), &n)
+			s.uploads[uploadID][n] = body
+			w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+		case r.Method == "POST":
+			var complete s3CompleteMultipartUpload
+			assert.NoError(t, xml.Unmarshal(body, &complete))
+			var object []byte
+			for i, part := range complete.Parts {
+				assert.Equal(t, i+1, part.PartNumber)
+				assert.Equal(t, fmt.Sprintf(`"etag-%d"`, i+1), part.ETag)
+				object = append(object, s.uploads[uploadID][part.PartNumber]...)
+			}
+			s.objects[key] = object
+			delete(s.uploads, uploadID)
+		case r.Method == "DELETE":
+			delete(s.uploads, uploadID)
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+	s.client = &S3Client{
+		httpClient: &http.Client{},
+		Endpoint:   s.URL,
+		Region:     "us-east-1",
+		Bucket:     "bucket",
+		AccessKey:  "access",
+		SecretKey:  "secret",
+	}
+	return s
+}
+
+// Signs the request again, as we received it, to check it matches
+func (s *testS3) validSignature(r *http.Request, body []byte) bool {
+	t, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	auth := r.Header.Get("Authorization")
+	signed := strings.Split(strings.TrimSuffix(strings.SplitN(auth, "SignedHeaders=", 2)[1], ","), ";")
+	for _, name := range signed {
+		name = strings.Split(name, ",")[0]
+		if name != "host" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	client := *s.client
+	client.now = func() time.Time { return t }
+	client.sign(req, body)
+	return req.Header.Get("Authorization") == auth
+}
+
+func (s *testS3) Objects() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := map[string]string{}
+	for key, object := range s.objects {
+		gz, err := gzip.NewReader(bytes.NewReader(object))
+		if err != nil {
+			objects[key] = "not gzipped"
+			continue
+		}
+		b, _ := ioutil.ReadAll(gz)
+		objects[key] = string(b)
+	}
+	return objects
+}
+
+func newTestS3Output(t *testing.T, client *S3Client) *S3Output {
+	dir, err := ioutil.TempDir("", "log-forwarder")
+	assert.NoError(t, err)
+	now := time.Date(2019, 7, 20, 0, 0, 0, 0, time.UTC)
+	return &S3Output{
+		Client:         client,
+		Prefix:         "archive/",
+		StagingDir:     dir,
+		MaxObjectBytes: 1024 * 1024,
+		MaxObjectAge:   time.Hour,
+		PartSize:       1024 * 1024,
+		UploadTimeout:  time.Minute,
+		now:            func() time.Time { return now },
+	}
+}
+
+// Entries with cursors c<n> and the given messages, logged just before midnight
+func s3TestEntries(first int, messages ...string) []LogEntry {
+	entries := testEntries(messages...)
+	for i := range entries {
+		entries[i].Cursor = fmt.Sprint("c", first+i)
+		entries[i].Timestamp = 1563580799000000
+	}
+	return entries
+}
+
+// What s3TestEntries are archived as, one line each
+func s3TestLines(metadata MetadataValues, entries []LogEntry) string {
+	var lines []string
+	for _, entry := range entries {
+		b, _ := json.Marshal(newJSONRecord(metadata, entry))
+		lines = append(lines, string(b)+"\n")
+	}
+	return strings.Join(lines, "")
+}
+
+func TestS3AccumulatesPerCategory(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+
+	kubelet := MetadataValues{category: "prod/systemd/kubelet", host: "node-1"}
+	nginx := MetadataValues{category: "prod/docker/nginx", host: "node-1"}
+	assert.NoError(t, s3.Send(context.Background(), kubelet, s3TestEntries(1, "one", "two")))
+	assert.NoError(t, s3.Send(context.Background(), nginx, s3TestEntries(3, "three")))
+	assert.NoError(t, s3.Send(context.Background(), kubelet, s3TestEntries(4, "four")))
+
+	// Nothing is due yet
+	s3.sealAll(false)
+	s3.UploadPending(nil)
+	assert.Empty(t, server.Objects())
+
+	// Picked up after a restart, once they are old enough
+	s3 = &S3Output{Client: s3.Client, Prefix: s3.Prefix, StagingDir: s3.StagingDir, MaxObjectAge: time.Hour}
+	s3.sealAll(false)
+	s3.UploadPending(nil)
+	assert.Equal(t, map[string]string{
+		"archive/prod/systemd/kubelet/2019/07/19/node-1-c1.ndjson.gz": s3TestLines(kubelet, s3TestEntries(1, "one", "two")) + s3TestLines(kubelet, s3TestEntries(4, "four")),
+		"archive/prod/docker/nginx/2019/07/19/node-1-c3.ndjson.gz":    s3TestLines(nginx, s3TestEntries(3, "three")),
+	}, server.Objects())
+
+	// All gone from staging
+	files, err := ioutil.ReadDir(filepath.Join(s3.StagingDir, s3PendingDir))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	assert.NoError(t, s3.Send(context.Background(), kubelet, s3TestEntries(5, "five")))
+	s3.sealAll(false)
+	s3.UploadPending(nil)
+	assert.Len(t, server.Objects(), 2)
+}
+
+func TestS3PartlyWrittenBatch(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+	metadata := MetadataValues{category: "c", host: "node-1"}
+	current := filepath.Join(s3.StagingDir, "c", s3CurrentObject+s3ObjectSuffix)
+
+	// As if we stopped part way through writing a batch, which is sent again after a restart
+	torn := func() {
+		f, err := os.OpenFile(current, os.O_WRONLY|os.O_APPEND, os.FileMode(0600))
+		if assert.NoError(t, err) {
+			_, err = f.Write(compress("partial")[:10])
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+		}
+	}
+	assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(1, "one")))
+	torn()
+	assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(2, "two")))
+	torn()
+
+	// Cut off when it's sent again, or when it's sealed
+	assert.Equal(t, 0, s3.Flush(time.Now().Add(time.Minute)))
+	assert.Equal(t, map[string]string{
+		"archive/c/2019/07/19/node-1-c1.ndjson.gz": s3TestLines(metadata, s3TestEntries(1, "one")) + s3TestLines(metadata, s3TestEntries(2, "two")),
+	}, server.Objects())
+	gz, err := gzip.NewReader(bytes.NewReader(server.objects["archive/c/2019/07/19/node-1-c1.ndjson.gz"]))
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(gz)
+		assert.NoError(t, err, "nothing after the last batch")
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+	s3.MaxObjectBytes = 1
+	s3.PartSize = 50
+
+	metadata := MetadataValues{category: "prod/systemd/kubelet", host: "node-1"}
+	entries := s3TestEntries(1, "one", "two", "three")
+	assert.NoError(t, s3.Send(context.Background(), metadata, entries))
+	s3.UploadPending(nil)
+
+	assert.Equal(t, map[string]string{
+		"archive/prod/systemd/kubelet/2019/07/19/node-1-c1.ndjson.gz": s3TestLines(metadata, entries),
+	}, server.Objects())
+	assert.Equal(t, "POST uploads=", server.requests[0])
+	assert.True(t, len(server.requests) > 3)
+	assert.Empty(t, server.uploads)
+}
+
+func TestS3UploadFailures(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+	s3.MaxObjectBytes = 1
+	metadata := MetadataValues{category: "c", host: "node-1"}
+	pending := filepath.Join(s3.StagingDir, s3PendingDir)
+
+	// Kept for next time
+	server.statuses = []int{500}
+	assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(1, "one")))
+	s3.UploadPending(nil)
+	assert.Empty(t, server.Objects())
+	files, _ := ioutil.ReadDir(pending)
+	assert.Len(t, files, 2)
+
+	// Bad credentials are reported
+	wrong := *server.client
+	wrong.SecretKey = "wrong"
+	s3.Client = &wrong
+	s3.UploadPending(nil)
+	assert.Contains(t, health.Problems(), "output s3: credentials rejected, status code: 403")
+	s3.Client = server.client
+
+	// Never going to be accepted, so put aside
+	server.statuses = []int{400}
+	s3.UploadPending(nil)
+	assert.Empty(t, server.Objects())
+	files, _ = ioutil.ReadDir(pending)
+	assert.Empty(t, files)
+	files, _ = ioutil.ReadDir(filepath.Join(s3.StagingDir, s3RejectedDir))
+	assert.Len(t, files, 2)
+	assert.NotContains(t, health.Problems(), "output s3: credentials rejected, status code: 403")
+}
+
+func TestS3Flush(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+	metadata := MetadataValues{category: "c", host: "node-1"}
+
+	// Left staged if it can't be uploaded in time
+	server.statuses = []int{500}
+	assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(1, "one", "two")))
+	assert.Equal(t, 2, s3.Flush(time.Now().Add(time.Minute)))
+	assert.Empty(t, server.Objects())
+
+	// Otherwise uploaded, however new
+	assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(3, "three")))
+	assert.Equal(t, 0, s3.Flush(time.Now().Add(time.Minute)))
+	assert.Len(t, server.Objects(), 2)
+}
+
+func TestS3RunStops(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s3.Run(stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return once stopped")
+	}
+}
+
+func TestS3StagingCap(t *testing.T) {
+	server := newTestS3(t)
+	defer server.Close()
+	s3 := newTestS3Output(t, server.client)
+	defer os.RemoveAll(s3.StagingDir)
+	s3.MaxObjectBytes = 1
+	metadata := MetadataValues{category: "c", host: "node-1"}
+	pending := filepath.Join(s3.StagingDir, s3PendingDir)
+
+	// Objects waiting to be uploaded, which can't get through
+	server.statuses = []int{500}
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(i, "message")))
+	}
+	s3.UploadPending(nil)
+	files, _ := ioutil.ReadDir(pending)
+	assert.Len(t, files, 6)
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+
+	// Nothing staged is dropped to make room, the batch waits in the spool instead
+	s3.MaxStagingBytes = total - 1
+	assert.Error(t, s3.Send(context.Background(), metadata, s3TestEntries(4, "message")))
+	files, _ = ioutil.ReadDir(pending)
+	assert.Len(t, files, 6)
+
+	// Until uploads catch up
+	assert.Equal(t, 0, s3.Flush(time.Now().Add(time.Minute)))
+	assert.NoError(t, s3.Send(context.Background(), metadata, s3TestEntries(4, "message")))
+	assert.Equal(t, 0, s3.Flush(time.Now().Add(time.Minute)))
+	var keys []string
+	for key := range server.Objects() {
+		keys = append(keys, filepath.Base(key))
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"node-1-c1.ndjson.gz", "node-1-c2.ndjson.gz", "node-1-c3.ndjson.gz", "node-1-c4.ndjson.gz"}, keys)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SplunkOutput sends entries to a Splunk HTTP Event Collector.
+// See: https://docs.splunk.com/Documentation/Splunk/latest/Data/HECRESTendpoints
+//
+// Indexer acknowledgement isn't used, a batch counts as delivered once HEC has
+// accepted it.
+type SplunkOutput struct {
+	httpClient *http.Client
+	URL        string // e.g https://splunk:8088
+	Token      string
+	Index      string // if empty, the token's default index
+	SourceType string // if empty, the entry's category
+}
+
+type splunkEvent struct {
+	Time       json.Number       `json:"time"` // seconds since the epoch
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      string            `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// What HEC responds with, whether it worked or not
+type splunkResponse struct {
+	Text string `json:"text"`
+	Code int    `json:"code"`
+}
+
+// HEC status codes that we treat differently to what the HTTP status says
+const (
+	splunkTokenDisabled = 1
+	splunkTokenRequired = 2
+	splunkInvalidAuth   = 3
+	splunkInvalidToken  = 4
+	splunkServerBusy    = 9
+)
+
+func (splunk *SplunkOutput) Name() string {
+	return "splunk"
+}
+
+func (splunk *SplunkOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	sourceType := splunk.SourceType
+	if sourceType == "" {
+		sourceType = metadata.category
+	}
+
+	// HEC takes events one after the other, not in an array
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, entry := range batch {
+		err := enc.Encode(splunkEvent{
+			Time:       json.Number(fmt.Sprintf("%d.%06d", entry.Timestamp/1e6, entry.Timestamp%1e6)),
+			Host:       metadata.host,
+			Source:     metadata.source,
+			SourceType: sourceType,
+			Index:      splunk.Index,
+			Event:      entry.Message,
+			Fields:     entry.Fields,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(splunk.URL, "/")+"/services/collector/event", bytes.NewReader(compress(body.String())))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Splunk "+splunk.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := splunk.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading splunk response: %s", err)
+	}
+	return splunkResponseError(resp, respBody)
+}
+
+// Classifies a HEC response like HTTPResponseError does, going by the HEC status
+// code in the body where it is more specific than the HTTP status.
+func splunkResponseError(resp *http.Response, body []byte) error {
+	var hec splunkResponse
+	if json.Unmarshal(body, &hec) != nil {
+		// Not from HEC, maybe a proxy in the way. All we have is the status.
+		return HTTPResponseError(resp, body)
+	}
+
+	switch hec.Code {
+	case 0:
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+	case splunkTokenDisabled, splunkTokenRequired, splunkInvalidAuth, splunkInvalidToken:
+		return &UnauthorizedError{StatusCode: resp.StatusCode}
+	case splunkServerBusy:
+		return &ThrottledError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	err := HTTPResponseError(resp, body)
+	switch err.(type) {
+	case nil:
+		// A 2xx, but HEC says it didn't work
+		return fmt.Errorf("splunk error %d: %s", hec.Code, hec.Text)
+	case *ThrottledError, *UnauthorizedError, *RejectedError:
+		return err
+	default:
+		return fmt.Errorf("%s: splunk error %d: %s", err, hec.Code, hec.Text)
+	}
+}
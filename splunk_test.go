@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testHEC is a stand in for a Splunk HTTP Event Collector, responding with
+// status and a HEC status code
+type testHEC struct {
+	*httptest.Server
+	mu      sync.Mutex
+	status  int
+	code    int
+	events  []splunkEvent
+	headers []http.Header
+}
+
+func newTestHEC(status int, code int) *testHEC {
+	hec := &testHEC{status: status, code: code}
+	hec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hec.mu.Lock()
+		defer hec.mu.Unlock()
+		hec.headers = append(hec.headers, r.Header)
+		gz, err := gzip.NewReader(r.Body)
+		if r.URL.Path != "/services/collector/event" || err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		dec := json.NewDecoder(gz)
+		for {
+			var event splunkEvent
+			err := dec.Decode(&event)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprint(w, `{"text":"Invalid data format","code":6}`)
+				return
+			}
+			if hec.code == 0 {
+				hec.events = append(hec.events, event)
+			}
+		}
+		w.WriteHeader(hec.status)
+		fmt.Fprintf(w, `{"text":"test","code":%d}`, hec.code)
+	}))
+	return hec
+}
+
+func TestSplunkEvents(t *testing.T) {
+	hec := newTestHEC(200, 0)
+	defer hec.Close()
+	splunk := &SplunkOutput{httpClient: &http.Client{}, URL: hec.URL, Token: "token", Index: "main"}
+
+	metadata := MetadataValues{category: "prod/systemd/kubelet", source: "kubelet", host: "node-1"}
+	entries := []LogEntry{
+		{Timestamp: 1563537600123456, Message: "one", Fields: map[string]string{"PRIORITY": "6"}},
+		{Timestamp: 1563537601000001, Message: "two", Fields: map[string]string{"PRIORITY": "3"}},
+	}
+	assert.NoError(t, splunk.Send(context.Background(), metadata, entries))
+
+	assert.Equal(t, "Splunk token", hec.headers[0].Get("Authorization"))
+	assert.Equal(t, "gzip", hec.headers[0].Get("Content-Encoding"))
+	assert.Equal(t, []splunkEvent{
+		{
+			Time:       "1563537600.123456",
+			Host:       "node-1",
+			Source:     "kubelet",
+			SourceType: "prod/systemd/kubelet",
+			Index:      "main",
+			Event:      "one",
+			Fields:     map[string]string{"PRIORITY": "6"},
+		},
+		{
+			Time:       "1563537601.000001",
+			Host:       "node-1",
+			Source:     "kubelet",
+			SourceType: "prod/systemd/kubelet",
+			Index:      "main",
+			Event:      "two",
+			Fields:     map[string]string{"PRIORITY": "3"},
+		},
+	}, hec.events)
+
+	// A configured sourcetype wins over the category
+	splunk.SourceType = "journald"
+	assert.NoError(t, splunk.Send(context.Background(), metadata, entries[:1]))
+	assert.Equal(t, "journald", hec.events[2].SourceType)
+}
+
+func TestSplunkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		code   int
+		want   interface{}
+	}{
+		{403, splunkInvalidToken, &UnauthorizedError{}},
+		{403, splunkTokenDisabled, &UnauthorizedError{}},
+		{401, splunkTokenRequired, &UnauthorizedError{}},
+		{503, splunkServerBusy, &ThrottledError{}},
+		{429, 0, &ThrottledError{}},
+		{400, 7, &RejectedError{}}, // incorrect index
+		{500, 8, nil},              // internal error, retried as normal
+		{200, 8, nil},
+	} {
+		hec := newTestHEC(tc.status, tc.code)
+		splunk := &SplunkOutput{httpClient: &http.Client{}, URL: hec.URL, Token: "token"}
+		err := splunk.Send(context.Background(), MetadataValues{}, testEntries("one"))
+		assert.Error(t, err, "%d %d", tc.status, tc.code)
+		if tc.want != nil {
+			assert.IsType(t, tc.want, err, "%d %d", tc.status, tc.code)
+		} else {
+			assert.Contains(t, err.Error(), "splunk error 8: test")
+		}
+		hec.Close()
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentSuffix = ".seg.gz"
+	spoolOffsetSuffix  = ".offset"
+
+	// How often a drainer looks for new segments when it has caught up
+	SpoolPollInterval = time.Second
+)
+
+// Spool is an on-disk queue of flushed buffers. Each flushed buffer is written as
+// its own gzipped segment file, named so that segments sort oldest first.
+//
+// Every output consumes the spool independently and keeps its own offset (the
+// oldest segment it still has to deliver) in an offset file next to the segments.
+// A segment is only deleted once every output has delivered it, so anything
+// spooled survives a restart or a collector outage, and a slow output doesn't
+// hold up the others. To bound disk usage the spool has a size cap, when it is
+// exceeded the oldest segments are dropped whether or not they were delivered.
+//
+// An output can have several drainers, each claims the oldest segment nobody else
+// is working on, so segments may be delivered out of order.
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+	Metrics  *Metrics
+
+	mu        sync.Mutex
+	nextSeq   uint64
+	consumers map[string]*spoolConsumer
+	written   chan struct{} // closed and replaced on every write, to wake idle drainers
+	closed    chan struct{}
+	drainers  sync.WaitGroup
+}
+
+type spoolConsumer struct {
+	offset  uint64          // oldest segment that isn't known to be delivered
+	claimed map[uint64]bool // being delivered by one of the consumer's drainers
+	acked   map[uint64]bool // delivered, but held past offset by an older segment
+}
+
+type spoolSegment struct {
+	Metadata MetadataValues `json:"metadata"`
+	Entries  []LogEntry     `json:"entries"`
+}
+
+// Opens the spool in dir for the named consumers, picking up their offsets from last time.
+func OpenSpool(dir string, maxBytes int64, consumers []string, metrics *Metrics) (*Spool, error) {
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		Dir:       dir,
+		MaxBytes:  maxBytes,
+		Metrics:   metrics,
+		consumers: map[string]*spoolConsumer{},
+		written:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	for _, name := range consumers {
+		offset, err := s.readOffset(name)
+		if err != nil {
+			return nil, err
+		}
+		s.consumers[name] = &spoolConsumer{
+			offset:  offset,
+			claimed: map[uint64]bool{},
+			acked:   map[uint64]bool{},
+		}
+	}
+
+	//carry on numbering from whatever was left behind last time
+	segments, err := s.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		s.nextSeq = segmentSeq(segments[len(segments)-1]) + 1
+		log.Println("Spool has segments to replay: ", len(segments))
+	}
+	for _, c := range s.consumers {
+		if c.offset > s.nextSeq {
+			s.nextSeq = c.offset
+		}
+	}
+	s.updateMetrics(segments)
+	return s, nil
+}
+
+// Writes a flushed buffer to the spool, returns the path of the new segment.
+func (s *Spool) Write(metadata MetadataValues, entries []LogEntry) (string, error) {
+	data, err := json.Marshal(spoolSegment{metadata, entries})
+	if err != nil {
+		return "", err
+	}
+	compressed := compress(string(data))
+
+	//hold the lock until the segment is in place, so drainers never see a gap in
+	//the sequence that is later filled in
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.nextSeq
+
+	//write then rename, so a drainer never sees a partial segment, and sync both before
+	//returning, as the caller moves the checkpoint past the entries once we do
+	path := filepath.Join(s.Dir, fmt.Sprintf("%020d%s", seq, spoolSegmentSuffix))
+	err = writeFileSynced(path, compressed)
+	if err != nil {
+		return "", err
+	}
+	s.nextSeq++
+
+	s.enforceCap()
+	s.Metrics.SpoolWrites.Inc(1)
+
+	close(s.written)
+	s.written = make(chan struct{})
+	return path, nil
+}
+
+// Returns the paths of all segments in the spool, oldest first
+func (s *Spool) Segments() ([]string, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), spoolSegmentSuffix) {
+			segments = append(segments, filepath.Join(s.Dir, f.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (s *Spool) Read(path string) (MetadataValues, []LogEntry, error) {
+	var segment spoolSegment
+	f, err := os.Open(path)
+	if err != nil {
+		return segment.Metadata, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return segment.Metadata, nil, err
+	}
+	err = json.NewDecoder(gz).Decode(&segment)
+	return segment.Metadata, segment.Entries, err
+}
+
+func (s *Spool) Remove(path string) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		// Not much we can do, it'll be delivered again after a restart
+		log.Println("Error removing spool segment: ", err)
+	}
+}
+
+// Hands spooled segments to deliver oldest first on behalf of the named consumer,
+// until the spool is closed. deliver should only return false if it gave up on a
+// segment because stop was closed. Segments left over from a previous run are
+// replayed first, then new ones as they are written. Drain can be run from several
+// goroutines for the same consumer to deliver segments concurrently.
+func (s *Spool) Drain(consumer string, deliver func(metadata MetadataValues, entries []LogEntry, stop <-chan struct{}) bool) {
+	if s.consumers[consumer] == nil {
+		log.Fatalln("Spool has no consumer named: ", consumer)
+	}
+	s.drainers.Add(1)
+	defer s.drainers.Done()
+
+	for !s.isClosed() {
+		segment, written := s.claim(consumer)
+		if segment == "" {
+			// Caught up, wait for something new
+			select {
+			case <-written:
+			case <-s.closed:
+			case <-time.After(SpoolPollInterval):
+			}
+			continue
+		}
+
+		seq := segmentSeq(segment)
+		metadata, entries, err := s.Read(segment)
+		if os.IsNotExist(err) {
+			// Dropped to make room while we were busy
+		} else if err != nil {
+			// Corrupt, most likely torn by a crash. Retrying won't help.
+			log.Println("Error reading spool segment, skipping: ", segment, err)
+			s.Metrics.SpoolCorrupt.Inc(1)
+		} else if !deliver(metadata, entries, s.closed) {
+			// Still spooled, we'll pick it up again next time
+			s.unclaim(consumer, seq)
+			return
+		}
+		s.ack(consumer, seq)
+	}
+}
+
+// Stops the drainers, anything they haven't delivered yet stays spooled
+func (s *Spool) Close() {
+	close(s.closed)
+	s.drainers.Wait()
+}
+
+func (s *Spool) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the oldest segment consumer still has to deliver that no other drainer
+// has claimed, or "" if there isn't one. Also returns a channel that is closed on
+// the next write, to wait on if there was nothing to claim.
+func (s *Spool) claim(consumer string) (string, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.consumers[consumer]
+	segments, err := s.Segments()
+	if err != nil {
+		log.Fatalln("Error listing spool: ", err)
+	}
+	for _, segment := range segments {
+		seq := segmentSeq(segment)
+		if seq >= c.offset && !c.claimed[seq] && !c.acked[seq] {
+			c.claimed[seq] = true
+			return segment, s.written
+		}
+	}
+	s.updateMetrics(segments)
+	return "", s.written
+}
+
+// Returns the segments that some consumer has yet to deliver, oldest first
+func (s *Spool) Undelivered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := s.Segments()
+	if err != nil {
+		log.Println("Error listing spool: ", err)
+		return nil
+	}
+	var undelivered []string
+	for _, segment := range segments {
+		seq := segmentSeq(segment)
+		for _, c := range s.consumers {
+			if seq >= c.offset && !c.acked[seq] {
+				undelivered = append(undelivered, segment)
+				break
+			}
+		}
+	}
+	return undelivered
+}
+
+func (s *Spool) unclaim(consumer string, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.consumers[consumer].claimed, seq)
+}
+
+// Marks seq delivered for consumer, moves its offset up to the oldest segment it
+// still has to deliver and removes any segments that every consumer is now past
+func (s *Spool) ack(consumer string, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.consumers[consumer]
+	delete(c.claimed, seq)
+	c.acked[seq] = true
+
+	segments, err := s.Segments()
+	if err != nil {
+		log.Println("Error listing spool: ", err)
+		return
+	}
+
+	offset := s.nextSeq
+	for _, segment := range segments {
+		seq := segmentSeq(segment)
+		if seq >= c.offset && !c.acked[seq] {
+			offset = seq
+			break
+		}
+	}
+	if offset != c.offset {
+		c.offset = offset
+		err = s.writeOffset(consumer, offset)
+		if err != nil {
+			log.Println("Error writing spool offset: ", err)
+		}
+		for seq := range c.acked {
+			if seq < offset {
+				delete(c.acked, seq)
+			}
+		}
+	}
+
+	minOffset := s.nextSeq
+	for _, c := range s.consumers {
+		if c.offset < minOffset {
+			minOffset = c.offset
+		}
+	}
+	for _, segment := range segments {
+		if segmentSeq(segment) < minOffset {
+			s.Remove(segment)
+		}
+	}
+}
+
+// Drops the oldest segments until the spool fits under MaxBytes. The newest segment
+// is always kept, even if it alone is over the cap. Called with the lock held.
+func (s *Spool) enforceCap() {
+	segments, err := s.Segments()
+	if err != nil {
+		log.Println("Error listing spool: ", err)
+		return
+	}
+	sizes := make([]int64, len(segments))
+	var total int64
+	for i, segment := range segments {
+		fi, err := os.Stat(segment)
+		if err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	dropped := 0
+	for ; total > s.MaxBytes && dropped < len(segments)-1; dropped++ {
+		log.Println("Spool full, dropping oldest segment: ", segments[dropped])
+		s.Remove(segments[dropped])
+		total -= sizes[dropped]
+		s.Metrics.SpoolDroppedSegments.Inc(1)
+		s.Metrics.SpoolDroppedBytes.Inc(sizes[dropped])
+	}
+	s.Metrics.SpoolSegments.Update(int64(len(segments) - dropped))
+	s.Metrics.SpoolBytes.Update(total)
+}
+
+func (s *Spool) updateMetrics(segments []string) {
+	var total int64
+	for _, segment := range segments {
+		fi, err := os.Stat(segment)
+		if err == nil {
+			total += fi.Size()
+		}
+	}
+	s.Metrics.SpoolSegments.Update(int64(len(segments)))
+	s.Metrics.SpoolBytes.Update(total)
+}
+
+func (s *Spool) readOffset(consumer string) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, consumer+spoolOffsetSuffix))
+	if os.IsNotExist(err) {
+		// New consumer, start with whatever is spooled
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (s *Spool) writeOffset(consumer string, offset uint64) error {
+	return writeFileSynced(filepath.Join(s.Dir, consumer+spoolOffsetSuffix), []byte(strconv.FormatUint(offset, 10)))
+}
+
+// Writes data to a temporary file and renames it to path, syncing the file and then
+// its directory so that after a crash path is either as it was or has all of data
+func writeFileSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Returns the sequence number a segment was written with
+func segmentSeq(path string) uint64 {
+	seq, _ := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), spoolSegmentSuffix), 10, 64)
+	return seq
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func newTestSpool(t *testing.T, maxBytes int64) *Spool {
+	dir, err := ioutil.TempDir("", "log-forwarder-spool")
+	assert.NoError(t, err)
+	metrics := &Metrics{}
+	metrics.Init()
+	s, err := OpenSpool(dir, maxBytes, []string{"a", "b"}, metrics)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer func() { s.Close() }()
+
+	metadata := MetadataValues{
+		source:           "source",
+		category:         "category",
+		host:             "host",
+		trustedTimestamp: true,
+		namespace:        "namespace",
+		pod:              "pod",
+		owner:            "owner",
+		ownerKind:        "ReplicaSet",
+		container:        "container",
+		labels:           map[string]string{"app": "app"},
+		routes:           []string{"sumo:soc", "s3"},
+		collector:        "ns-a.team-a",
+		image:            "image:1.0",
+		node:             "node",
+		unit:             "unit.service",
+	}
+	path, err := s.Write(metadata, testEntries("one", "two"))
+	assert.NoError(t, err)
+
+	segments, err := s.Segments()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path}, segments)
+
+	readMetadata, entries, err := s.Read(path)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, readMetadata)
+	assert.Equal(t, testEntries("one", "two"), entries)
+
+	s.Remove(path)
+	segments, err = s.Segments()
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+}
+
+func TestSpoolCapDropsOldest(t *testing.T) {
+	// Small enough that only one segment fits
+	s := newTestSpool(t, 50)
+	defer os.RemoveAll(s.Dir)
+	defer func() { s.Close() }()
+
+	_, err := s.Write(MetadataValues{}, testEntries("first"))
+	assert.NoError(t, err)
+	_, err = s.Write(MetadataValues{}, testEntries("second"))
+	assert.NoError(t, err)
+	newest, err := s.Write(MetadataValues{}, testEntries("third"))
+	assert.NoError(t, err)
+
+	segments, err := s.Segments()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{newest}, segments)
+	assert.Equal(t, int64(2), s.Metrics.SpoolDroppedSegments.Count())
+}
+
+func TestSpoolReplay(t *testing.T) {
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer func() { s.Close() }()
+	_, err := s.Write(MetadataValues{}, testEntries("one", "two"))
+	assert.NoError(t, err)
+	_, err = s.Write(MetadataValues{}, testEntries("three"))
+	assert.NoError(t, err)
+
+	// Restart, new segments must sort after the ones left behind
+	s.Close()
+	s, err = OpenSpool(s.Dir, s.MaxBytes, []string{"a", "b"}, s.Metrics)
+	assert.NoError(t, err)
+	_, err = s.Write(MetadataValues{}, testEntries("four"))
+	assert.NoError(t, err)
+
+	collector := newTestCollector(200)
+	defer collector.Close()
+	go s.Drain("a", NewOutputWorker(newTestSumoUploader(collector.URL), s.Metrics).Deliver)
+
+	// Segments are kept until every consumer has delivered them
+	waitFor(t, func() bool {
+		return len(collector.Lines()) == 4
+	})
+	assert.Equal(t, []string{"one", "two", "three", "four"}, collector.Lines())
+	segments, err := s.Segments()
+	assert.NoError(t, err)
+	assert.Len(t, segments, 3)
+
+	b := &testOutput{}
+	go s.Drain("b", NewOutputWorker(b, s.Metrics).Deliver)
+	waitFor(t, func() bool {
+		segments, _ := s.Segments()
+		return len(segments) == 0
+	})
+	assert.Equal(t, []string{"one", "two", "three", "four"}, b.Messages())
+}
+
+func TestSpoolOffsetsSurviveRestart(t *testing.T) {
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer func() { s.Close() }()
+	_, err := s.Write(MetadataValues{}, testEntries("one"))
+	assert.NoError(t, err)
+
+	a := &testOutput{}
+	go s.Drain("a", NewOutputWorker(a, s.Metrics).Deliver)
+	waitFor(t, func() bool {
+		return len(a.Messages()) == 1
+	})
+
+	// "a" has delivered "one" already, so after a restart only "b" gets it
+	s.Close()
+	s, err = OpenSpool(s.Dir, s.MaxBytes, []string{"a", "b"}, s.Metrics)
+	assert.NoError(t, err)
+	_, err = s.Write(MetadataValues{}, testEntries("two"))
+	assert.NoError(t, err)
+
+	a = &testOutput{}
+	b := &testOutput{}
+	go s.Drain("a", NewOutputWorker(a, s.Metrics).Deliver)
+	go s.Drain("b", NewOutputWorker(b, s.Metrics).Deliver)
+	waitFor(t, func() bool {
+		return len(b.Messages()) == 2
+	})
+	assert.Equal(t, []string{"one", "two"}, b.Messages())
+	assert.Equal(t, []string{"two"}, a.Messages())
+}
+
+func TestSpoolConcurrentDrainers(t *testing.T) {
+	s := newTestSpool(t, 1024*1024)
+	defer os.RemoveAll(s.Dir)
+	defer func() { s.Close() }()
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		message := fmt.Sprintf("message %d", i)
+		want = append(want, message)
+		_, err := s.Write(MetadataValues{}, testEntries(message))
+		assert.NoError(t, err)
+	}
+
+	a := &testOutput{}
+	b := &testOutput{}
+	for i := 0; i < 4; i++ {
+		go s.Drain("a", NewOutputWorker(a, s.Metrics).Deliver)
+		go s.Drain("b", NewOutputWorker(b, s.Metrics).Deliver)
+	}
+	waitFor(t, func() bool {
+		segments, _ := s.Segments()
+		return len(segments) == 0
+	})
+
+	// Every segment exactly once, in whatever order the drainers got to them
+	for _, o := range []*testOutput{a, b} {
+		got := o.Messages()
+		sort.Strings(got)
+		sort.Strings(want)
+		assert.Equal(t, want, got)
+	}
+	offset, err := s.readOffset("a")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50), offset)
+}
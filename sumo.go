@@ -8,12 +8,37 @@ import (
 
 	"bytes"
 	"compress/gzip"
-	"io"
+	"context"
+	"fmt"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
 )
 
+// Metadata that can be sent as X-Sumo-Fields, so it can be searched without parsing
+// the category. Only DefaultSumoFieldAllowlist by default, see SumoUploader.FieldAllowlist.
+var SumoMetadataFields = map[string]func(m MetadataValues) string{
+	"namespace":  func(m MetadataValues) string { return m.namespace },
+	"pod":        func(m MetadataValues) string { return m.pod },
+	"container":  func(m MetadataValues) string { return m.container },
+	"owner":      func(m MetadataValues) string { return m.owner },
+	"owner_kind": func(m MetadataValues) string { return m.ownerKind },
+	"image":      func(m MetadataValues) string { return m.image },
+	"node":       func(m MetadataValues) string { return m.node },
+	"unit":       func(m MetadataValues) string { return m.unit },
+}
+
+// The fields sent by default, the ones that are few enough per cluster to stay
+// within Sumo's field limits. The rest have to be asked for.
+var DefaultSumoFieldAllowlist = []string{"namespace", "container", "owner", "owner_kind", "node"}
+
+// Field values can't contain the separators
+var sumoFieldValueReplacer = strings.NewReplacer(",", "_", "=", "_")
+
 type SumoUploader struct {
 	httpClient *http.Client
 	Metrics    *Metrics
@@ -27,9 +52,37 @@ type SumoUploader struct {
 	//so it will just use the receipt time / processing time of the log entry as the
 	//searchable timestamp. This is the least worst way of making log entry timing mostly correct
 	UntrustedTimestampCollectorUrl string
+
+	//urls of other collectors by name, entries are only sent to these when a route
+	//names one, e.g. sumo:soc (see RoutingRules)
+	Collectors map[string]string
+
+	//collectors that pods can ask for by name with an annotation, from their namespace's, when set
+	CollectorMap *CollectorMap
+
+	//used instead of the trusted and untrusted collectors while they are down, if set.
+	//e.g. a second sumo deployment or an internal relay, see Failover
+	FailoverTrustedTimestampCollectorUrl   string
+	FailoverUntrustedTimestampCollectorUrl string
+	FailoverAfter                          time.Duration
+	FailoverProbeInterval                  time.Duration
+
+	//sent as X-Sumo-Fields with every upload, e.g. cluster=prod
+	StaticFields map[string]string
+
+	//metadata to send as X-Sumo-Fields, from SumoMetadataFields
+	FieldAllowlist []string
+
+	// Open a collector's circuit breaker after this many consecutive failures, 0 disables them
+	BreakerThreshold int
+	BreakerCoolDown  time.Duration
+
+	mu        sync.Mutex
+	breakers  map[string]*CircuitBreaker // by collector url
+	failovers map[string]*Failover       // by collector name
 }
 
-//Must get a value from one of the given env variables or fail
+// Must get a value from one of the given env variables or fail
 func MustGetEnv(envVariables ...string) string {
 	for _, envValue := range envVariables {
 		foundValue := os.Getenv(envValue)
@@ -52,7 +105,7 @@ func MustGetEnv(envVariables ...string) string {
 	X-Sumo-Host: Desired host name.
 	X-Sumo-Category: Desired source category.
 
-	SumoLogic Response Codes:
+	SumoLogic Response Codes (see HTTPResponseError for how we handle them):
 
 	200	HTTP request received and processed successfully.
 	401	HTTP request was rejected due to missing or invalid URL token.
@@ -86,67 +139,245 @@ func compress(s string) []byte {
 	return b.Bytes()
 }
 
-func (sumo *SumoUploader) UploadLogEntries(metadata MetadataValues, lines []string) {
-	const lineSep = "\n"
-	const requestTimeout = 10 * time.Second
+func (sumo *SumoUploader) Name() string {
+	return "sumo"
+}
 
-	uncompressedLogData := strings.Join(lines, lineSep)
-	logData := compress(uncompressedLogData)
+func (sumo *SumoUploader) HasCollector(name string) bool {
+	return sumo.Collectors[name] != ""
+}
 
-Retry:
-	for attempts := 0; ; /* no condition... */ attempts++ {
-		backoffSecs := backoff(attempts)
-		if backoffSecs > 0 {
-			log.Printf("Backing off for %d seconds", backoffSecs)
-			time.Sleep(time.Duration(backoffSecs) * time.Second)
+func (sumo *SumoUploader) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	lines := make([]string, len(batch))
+	for i, entry := range batch {
+		lines[i] = entry.Message
+	}
+	return sumo.UploadLogEntries(ctx, metadata, lines)
+}
+
+// Makes one attempt to upload lines to sumo, retrying is up to the caller
+func (sumo *SumoUploader) UploadLogEntries(ctx context.Context, metadata MetadataValues, lines []string) error {
+	if name, collectorURL := sumo.tenantCollector(metadata); collectorURL != "" {
+		err := sumo.postToTenant(ctx, name, collectorURL, metadata, lines)
+		switch err.(type) {
+		case *UnauthorizedError:
+			log.Printf("sumo: %s collector rejected our credentials, sending to the default collectors instead: %s", name, err)
+		case *CircuitOpenError:
+		default:
+			return err
 		}
-		// ctx, _ := context.WithTimeout(context.Background(), requestTimeout)
-		// TODO: should not be willing to block forever here.
+	}
 
-		uploadStart := time.Now()
+	name, collectorURL := sumo.collector(metadata)
+	if collectorURL == "" {
+		// Spooled before the collector was removed from the config, it's got nowhere to go
+		return &RejectedError{Body: "no url for sumo collector " + name}
+	}
 
-		collectorURL := sumo.TrustedTimestampCollectorUrl
-		if metadata.trustedTimestamp == false {
-			collectorURL = sumo.UntrustedTimestampCollectorUrl
-		}
+	failover := sumo.failover(name)
+	primary := failover == nil || failover.UsePrimary()
+	if !primary {
+		name, collectorURL = name+".failover", failover.Secondary
+	}
+	err := sumo.postWithBreaker(ctx, name, collectorURL, metadata, lines)
+	if primary && failover != nil {
+		failover.Record(err)
+	}
+	return err
+}
 
-		req, err := http.NewRequest("POST", collectorURL, bytes.NewReader(logData))
+func (sumo *SumoUploader) postWithBreaker(ctx context.Context, name string, collectorURL string, metadata MetadataValues, lines []string) error {
+	breaker := sumo.breaker(name, collectorURL)
+	if breaker != nil {
+		err := breaker.Allow()
 		if err != nil {
-			panic(err)
+			return err
 		}
-		req.Header.Set("Content-Type", "text/plain")
-		req.Header.Set("X-Sumo-Name", metadata.source)
-		req.Header.Set("X-Sumo-Host", metadata.host)
-		req.Header.Set("X-Sumo-Category", metadata.category)
-		req.Header.Set("Content-Encoding", "gzip")
+	}
+	err := sumo.post(ctx, collectorURL, metadata, lines)
+	if breaker != nil {
+		breaker.Record(EndpointFailed(err))
+	}
+	return err
+}
 
-		resp, err := sumo.httpClient.Do(req)
+// Sends to a tenant's collector. Its health and breaker are its own, so a tenant whose
+// collector is down or rejects our credentials only fails its own health check, and
+// the caller sends its logs to the default collectors rather than holding up the
+// workers, and with them every other tenant.
+func (sumo *SumoUploader) postToTenant(ctx context.Context, name string, collectorURL string, metadata MetadataValues, lines []string) error {
+	breaker := sumo.breaker(name, collectorURL)
+	if breaker != nil {
+		err := breaker.Allow()
 		if err != nil {
-			sumo.Metrics.BufferUploadFailure.Inc(1)
-			log.Println("Error uploading logs:", err)
-			continue Retry
+			return err
 		}
-		_, err = io.Copy(ioutil.Discard, resp.Body)
-		_ = resp.Body.Close()
-		if err != nil {
-			// Transport error reading response, don't assume logs were uploaded
-			sumo.Metrics.BufferUploadFailure.Inc(1)
-			log.Println("Error reading sumo response:", err)
-			continue Retry
-		} else if resp.StatusCode != 200 {
-			// HTTP error reading response. Again, assume logs were not uploaded
-			sumo.Metrics.BufferUploadFailure.Inc(1)
-			log.Println("Failed upload to sumo server, status code: ", resp.StatusCode)
-			continue Retry
+	}
+	err := sumo.post(ctx, collectorURL, metadata, lines)
+	_, unauthorized := err.(*UnauthorizedError)
+	if breaker != nil {
+		breaker.Record(EndpointFailed(err) || unauthorized)
+	}
+	if unauthorized {
+		health.Fail("output sumo collector "+name, err.Error())
+	} else if err == nil {
+		health.Recover("output sumo collector " + name)
+	}
+	return err
+}
+
+// Returns the name and url of the collector the pod asked for, if its namespace has
+// one by that name and no route overrides it, or empties. The url is looked up for
+// every batch, so it follows changes to the CollectorMap, and stays out of the spool.
+func (sumo *SumoUploader) tenantCollector(metadata MetadataValues) (string, string) {
+	if _, name := metadata.routeTo(sumo.Name()); name != "" || metadata.collector == "" || sumo.CollectorMap == nil {
+		return "", ""
+	}
+	url := sumo.CollectorMap.URL(metadata.namespace, metadata.collector)
+	if url == "" {
+		return "", ""
+	}
+	return metadata.namespace + "." + metadata.collector, url
+}
+
+// Returns the name and url of the collector to send to, other than a tenant's. A
+// route takes precedence, then the trusted or untrusted collector.
+func (sumo *SumoUploader) collector(metadata MetadataValues) (string, string) {
+	if _, name := metadata.routeTo(sumo.Name()); name != "" {
+		return name, sumo.Collectors[name]
+	}
+	if metadata.trustedTimestamp == false {
+		return "untrusted", sumo.UntrustedTimestampCollectorUrl
+	}
+	return "trusted", sumo.TrustedTimestampCollectorUrl
+}
+
+func (sumo *SumoUploader) post(ctx context.Context, collectorURL string, metadata MetadataValues, lines []string) error {
+	const lineSep = "\n"
+
+	uncompressedLogData := strings.Join(lines, lineSep)
+	logData := compress(uncompressedLogData)
+
+	uploadStart := time.Now()
+
+	req, err := http.NewRequest("POST", collectorURL, bytes.NewReader(logData))
+	if err != nil {
+		panic(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Sumo-Name", metadata.source)
+	req.Header.Set("X-Sumo-Host", metadata.host)
+	req.Header.Set("X-Sumo-Category", metadata.category)
+	if fields := sumo.fields(metadata); fields != "" {
+		req.Header.Set("X-Sumo-Fields", fields)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := sumo.httpClient.Do(req)
+	if err != nil {
+		sumo.Metrics.BufferUploadFailure.Inc(1)
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		// Transport error reading response, don't assume logs were uploaded
+		sumo.Metrics.BufferUploadFailure.Inc(1)
+		return fmt.Errorf("error reading sumo response: %s", err)
+	}
+	err = HTTPResponseError(resp, body)
+	if err != nil {
+		// HTTP error, assume logs were not uploaded. The worker decides what to do about it.
+		sumo.Metrics.BufferUploadFailure.Inc(1)
+		return err
+	}
+
+	// We did it ┣┓웃┏♨❤♨┑유┏┥
+	sumo.Metrics.BufferUploadSuccess.Inc(1)
+	sumo.Metrics.UploadMessages.Inc(int64(len(lines)))
+	sumo.Metrics.UploadBytesUncompressed.Inc(int64(len(uncompressedLogData)))
+	sumo.Metrics.UploadBytesCompressed.Inc(int64(len(logData)))
+	sumo.Metrics.UploadTime.UpdateSince(uploadStart)
+	return nil
+}
+
+// Returns the X-Sumo-Fields header, e.g. cluster=prod,namespace=default,pod=app-6f9c,
+// the static fields and whichever allowed metadata the batch has, sorted by name
+func (sumo *SumoUploader) fields(metadata MetadataValues) string {
+	fields := map[string]string{}
+	for name, value := range sumo.StaticFields {
+		fields[name] = value
+	}
+	for _, name := range sumo.FieldAllowlist {
+		if get := SumoMetadataFields[name]; get != nil && get(metadata) != "" {
+			fields[name] = get(metadata)
 		}
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + sumoFieldValueReplacer.Replace(fields[name])
+	}
+	return strings.Join(pairs, ",")
+}
 
-		// We did it ┣┓웃┏♨❤♨┑유┏┥
-		sumo.Metrics.BufferUploadSuccess.Inc(1)
-		sumo.Metrics.UploadMessages.Inc(int64(len(lines)))
-		sumo.Metrics.UploadBytesUncompressed.Inc(int64(len(uncompressedLogData)))
-		sumo.Metrics.UploadBytesCompressed.Inc(int64(len(logData)))
-		sumo.Metrics.UploadTime.UpdateSince(uploadStart)
+// Returns the circuit breaker for a collector url, or nil if they're disabled.
+// The collectors share a breaker if they have the same url, named after the first.
+func (sumo *SumoUploader) breaker(name string, collectorURL string) *CircuitBreaker {
+	if sumo.BreakerThreshold <= 0 {
+		return nil
+	}
+	sumo.mu.Lock()
+	defer sumo.mu.Unlock()
+	if sumo.breakers == nil {
+		sumo.breakers = map[string]*CircuitBreaker{}
+	}
+	b := sumo.breakers[collectorURL]
+	if b == nil {
+		state := metrics.GetOrRegisterGauge("output.sumo.breaker."+name+".state", sumo.Metrics.Registry)
+		b = NewCircuitBreaker("sumo "+name+" collector", sumo.BreakerThreshold, sumo.BreakerCoolDown, state)
+		sumo.breakers[collectorURL] = b
+	}
+	return b
+}
 
-		break
+// Returns the failover for the trusted or untrusted collector, or nil if it doesn't
+// have a secondary
+func (sumo *SumoUploader) failover(name string) *Failover {
+	secondary := ""
+	switch name {
+	case "trusted":
+		secondary = sumo.FailoverTrustedTimestampCollectorUrl
+	case "untrusted":
+		secondary = sumo.FailoverUntrustedTimestampCollectorUrl
+	}
+	if secondary == "" {
+		return nil
+	}
+	sumo.mu.Lock()
+	defer sumo.mu.Unlock()
+	if sumo.failovers == nil {
+		sumo.failovers = map[string]*Failover{}
+	}
+	f := sumo.failovers[name]
+	if f == nil {
+		after, probeInterval := sumo.FailoverAfter, sumo.FailoverProbeInterval
+		if after <= 0 {
+			after = DefaultFailoverAfter
+		}
+		if probeInterval <= 0 {
+			probeInterval = DefaultFailoverProbeInterval
+		}
+		prefix := "output.sumo.failover." + name + "."
+		f = NewFailover("sumo "+name+" collector", secondary, after, probeInterval,
+			metrics.GetOrRegisterGauge(prefix+"active", sumo.Metrics.Registry),
+			metrics.GetOrRegisterTimer(prefix+"duration", sumo.Metrics.Registry))
+		sumo.failovers[name] = f
 	}
+	return f
 }
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBackoff(t *testing.T) {
@@ -16,3 +28,411 @@ func TestBackoff(t *testing.T) {
 	assert.Equal(t, 64, backoff(7))
 	assert.Equal(t, 120, backoff(8))
 }
+
+// testCollector is a stand in for a SumoLogic HTTP collector
+type testCollector struct {
+	*httptest.Server
+	mu         sync.Mutex
+	status     int
+	retryAfter string
+	requests   int
+	lines      []string
+}
+
+func newTestCollector(status int) *testCollector {
+	c := &testCollector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests++
+		if c.retryAfter != "" {
+			w.Header().Set("Retry-After", c.retryAfter)
+		}
+		if c.status == 200 {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			body, _ := ioutil.ReadAll(gz)
+			c.lines = append(c.lines, strings.Split(string(body), "\n")...)
+		}
+		w.WriteHeader(c.status)
+	}))
+	return c
+}
+
+func (c *testCollector) SetStatus(status int, retryAfter string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+	c.retryAfter = retryAfter
+}
+
+func (c *testCollector) Requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
+}
+
+func (c *testCollector) Lines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lines
+}
+
+func newTestSumoUploader(url string) *SumoUploader {
+	metrics := &Metrics{}
+	metrics.Init()
+	return &SumoUploader{
+		httpClient:                     &http.Client{},
+		Metrics:                        metrics,
+		TrustedTimestampCollectorUrl:   url,
+		UntrustedTimestampCollectorUrl: url,
+	}
+}
+
+// Delivers a batch to a collector that responds with status until the worker first
+// backs off, then with 200. Returns the worker and how long it slept each time.
+func deliverWithStatus(t *testing.T, status int, retryAfter string) (*testCollector, *OutputWorker, []time.Duration, bool) {
+	collector := newTestCollector(status)
+	collector.retryAfter = retryAfter
+	sumo := newTestSumoUploader(collector.URL)
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+	var sleeps []time.Duration
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		sleeps = append(sleeps, d)
+		collector.SetStatus(200, "")
+		return true
+	}
+	delivered := worker.Deliver(MetadataValues{}, testEntries("one", "two"), nil)
+	return collector, worker, sleeps, delivered
+}
+
+func TestSumoSuccess(t *testing.T) {
+	collector, worker, sleeps, delivered := deliverWithStatus(t, 200, "")
+	defer collector.Close()
+	assert.True(t, delivered)
+	assert.Empty(t, sleeps)
+	assert.Equal(t, []string{"one", "two"}, collector.Lines())
+	assert.Equal(t, int64(1), worker.Metrics.UploadSuccess.Count())
+	assert.Equal(t, int64(0), worker.Metrics.UploadFailure.Count())
+}
+
+func TestSumoThrottledRetryAfterSeconds(t *testing.T) {
+	collector, worker, sleeps, delivered := deliverWithStatus(t, 429, "30")
+	defer collector.Close()
+	assert.True(t, delivered)
+	assert.Equal(t, []string{"one", "two"}, collector.Lines())
+	assert.Len(t, sleeps, 1)
+	// Retry-After plus up to 20% jitter
+	assert.True(t, sleeps[0] >= 30*time.Second && sleeps[0] <= 36*time.Second, sleeps[0].String())
+	assert.Equal(t, int64(1), worker.Metrics.UploadThrottled.Count())
+	assert.Equal(t, int64(1), worker.Metrics.UploadFailure.Count())
+}
+
+func TestSumoThrottledRetryAfterDate(t *testing.T) {
+	retryAfter := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	collector, worker, sleeps, delivered := deliverWithStatus(t, 503, retryAfter)
+	defer collector.Close()
+	assert.True(t, delivered)
+	assert.Len(t, sleeps, 1)
+	assert.True(t, sleeps[0] >= 58*time.Second && sleeps[0] <= 72*time.Second, sleeps[0].String())
+	assert.Equal(t, int64(1), worker.Metrics.UploadThrottled.Count())
+}
+
+func TestSumoThrottledWithoutRetryAfter(t *testing.T) {
+	collector, _, sleeps, delivered := deliverWithStatus(t, 503, "")
+	defer collector.Close()
+	assert.True(t, delivered)
+	assert.Len(t, sleeps, 1)
+	assert.True(t, sleeps[0] >= time.Second && sleeps[0] <= 1200*time.Millisecond, sleeps[0].String())
+}
+
+func TestSumoUnauthorized(t *testing.T) {
+	collector := newTestCollector(401)
+	defer collector.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+
+	// Keeps retrying, but fails the health check and says so
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		if worker.failures == 3 {
+			assert.Equal(t, []string{"output sumo: credentials rejected, status code: 401"}, health.Problems())
+			assert.Equal(t, int64(0), worker.Metrics.Healthy.Value())
+			collector.SetStatus(200, "")
+		}
+		return true
+	}
+	assert.True(t, worker.Deliver(MetadataValues{}, testEntries("one"), nil))
+	assert.Equal(t, 4, collector.Requests())
+	assert.Equal(t, int64(3), worker.Metrics.UploadUnauthorized.Count())
+
+	// and recovers once the collector takes our logs again
+	assert.Empty(t, health.Problems())
+	assert.Equal(t, int64(1), worker.Metrics.Healthy.Value())
+}
+
+func TestSumoRejectedIsDeadLettered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-forwarder-deadletter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	collector := newTestCollector(400)
+	defer collector.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+	worker.DeadLetterDir = dir
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		t.Fatal("rejected batches shouldn't be retried")
+		return false
+	}
+
+	assert.True(t, worker.Deliver(MetadataValues{source: "source"}, testEntries("one", "two"), nil))
+	assert.Equal(t, 1, collector.Requests())
+	assert.Equal(t, int64(1), worker.Metrics.UploadRejected.Count())
+	assert.Equal(t, int64(2), worker.Metrics.DeadLetterMessages.Count())
+
+	files, err := filepath.Glob(filepath.Join(dir, "sumo", "*.json.gz"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	f, err := os.Open(files[0])
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	var letter deadLetter
+	assert.NoError(t, json.NewDecoder(gz).Decode(&letter))
+	assert.Equal(t, "sumo", letter.Output)
+	assert.Equal(t, "source", letter.Metadata.source)
+	assert.Equal(t, testEntries("one", "two"), letter.Entries)
+	assert.Contains(t, letter.Error, "400")
+}
+
+func TestSumoServerError(t *testing.T) {
+	collector, worker, sleeps, delivered := deliverWithStatus(t, 500, "")
+	defer collector.Close()
+	assert.True(t, delivered)
+	assert.Equal(t, []time.Duration{time.Second}, sleeps)
+	assert.Equal(t, int64(1), worker.Metrics.UploadFailure.Count())
+	assert.Equal(t, int64(0), worker.Metrics.UploadThrottled.Count())
+	assert.Equal(t, int64(0), worker.Metrics.UploadRejected.Count())
+}
+
+func TestSumoCircuitBreaker(t *testing.T) {
+	collector := newTestCollector(500)
+	defer collector.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	sumo.BreakerThreshold = 3
+	sumo.BreakerCoolDown = 50 * time.Millisecond
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+
+	var sleeps []time.Duration
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		sleeps = append(sleeps, d)
+		if d < time.Second {
+			// Waiting out the breaker, which only happens after 3 failed requests
+			assert.Equal(t, 3, collector.Requests())
+			assert.Equal(t, int64(BreakerOpen), sumo.breaker("trusted", collector.URL).State.Value())
+			time.Sleep(d)
+			collector.SetStatus(200, "")
+		}
+		return true
+	}
+
+	assert.True(t, worker.Deliver(MetadataValues{trustedTimestamp: true}, testEntries("one"), nil))
+	assert.Equal(t, 4, collector.Requests())
+	assert.Len(t, sleeps, 4)
+	assert.Equal(t, int64(3), worker.Metrics.UploadFailure.Count())
+	assert.Equal(t, int64(BreakerClosed), sumo.breaker("trusted", collector.URL).State.Value())
+	assert.Equal(t, int64(BreakerClosed), sumo.Metrics.Registry.Get("output.sumo.breaker.trusted.state").(metrics.Gauge).Value())
+}
+
+func TestSumoRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer collector.Close()
+	defer close(release)
+
+	sumo := newTestSumoUploader(collector.URL)
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+	worker.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := worker.send(MetadataValues{}, testEntries("one"), nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "deadline exceeded")
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Stopping abandons an attempt in flight too
+	worker.Timeout = 0
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() {
+		close(stop)
+	})
+	err = worker.send(MetadataValues{}, testEntries("one"), stop)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "canceled")
+}
+
+func TestSumoRoutedToNamedCollector(t *testing.T) {
+	collector := newTestCollector(200)
+	defer collector.Close()
+	soc := newTestCollector(200)
+	defer soc.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	sumo.Collectors = map[string]string{"soc": soc.URL}
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+
+	assert.True(t, worker.Deliver(MetadataValues{routes: []string{"sumo:soc"}}, testEntries("audit"), nil))
+	assert.True(t, worker.Deliver(MetadataValues{routes: []string{"sumo"}}, testEntries("app"), nil))
+	assert.True(t, worker.Deliver(MetadataValues{routes: []string{"s3"}}, testEntries("archive"), nil))
+	assert.Equal(t, []string{"audit"}, soc.Lines())
+	assert.Equal(t, []string{"app"}, collector.Lines())
+
+	// A collector that is no longer configured is never going to work
+	err := sumo.Send(context.Background(), MetadataValues{routes: []string{"sumo:gone"}}, testEntries("lost"))
+	assert.IsType(t, &RejectedError{}, err)
+}
+
+func TestSumoTenantCollector(t *testing.T) {
+	collector := newTestCollector(200)
+	defer collector.Close()
+	tenant := newTestCollector(200)
+	defer tenant.Close()
+	soc := newTestCollector(200)
+	defer soc.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	sumo.Collectors = map[string]string{"soc": soc.URL}
+	sumo.CollectorMap = newTestCollectorMap(t, `{"ns-a": {"team-a": "`+tenant.URL+`"}, "ns-b": {"team-b": "http://b"}}`)
+	defer os.Remove(sumo.CollectorMap.Path)
+
+	ctx := context.Background()
+	teamA := MetadataValues{namespace: "ns-a", collector: "team-a"}
+	assert.NoError(t, sumo.Send(ctx, teamA, testEntries("tenant")))
+	assert.NoError(t, sumo.Send(ctx, MetadataValues{}, testEntries("default")))
+	// A pod can't send to another namespace's collector, it gets the default collectors
+	assert.NoError(t, sumo.Send(ctx, MetadataValues{namespace: "ns-b", collector: "team-a"}, testEntries("other namespace")))
+	// Routes come first, so a tenant can't keep its audit logs from the SOC
+	teamA.routes = []string{"sumo:soc"}
+	assert.NoError(t, sumo.Send(ctx, teamA, testEntries("audit")))
+
+	assert.Equal(t, []string{"tenant"}, tenant.Lines())
+	assert.Equal(t, []string{"default", "other namespace"}, collector.Lines())
+	assert.Equal(t, []string{"audit"}, soc.Lines())
+
+	// The url is looked up as each batch is sent, so it follows the map, and only
+	// the collector's name is spooled
+	moved := newTestCollector(200)
+	defer moved.Close()
+	assert.NoError(t, ioutil.WriteFile(sumo.CollectorMap.Path, []byte(`{"ns-a": {"team-a": "`+moved.URL+`"}}`), 0600))
+	sumo.CollectorMap.checked = time.Time{}
+	sumo.CollectorMap.modTime = time.Time{}
+	assert.NoError(t, sumo.Send(ctx, MetadataValues{namespace: "ns-a", collector: "team-a"}, testEntries("moved")))
+	assert.Equal(t, []string{"moved"}, moved.Lines())
+	encoded, err := json.Marshal(teamA)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encoded), tenant.URL)
+}
+
+func TestSumoBadTenantDoesntHoldUpOthers(t *testing.T) {
+	collector := newTestCollector(200)
+	defer collector.Close()
+	bad := newTestCollector(401)
+	defer bad.Close()
+	good := newTestCollector(200)
+	defer good.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	sumo.BreakerThreshold = 2
+	sumo.BreakerCoolDown = time.Hour
+	sumo.CollectorMap = newTestCollectorMap(t, `{"ns-a": {"team-a": "`+bad.URL+`"}, "ns-b": {"team-b": "`+good.URL+`"}}`)
+	defer os.Remove(sumo.CollectorMap.Path)
+	worker := NewOutputWorker(sumo, sumo.Metrics)
+	worker.sleep = func(d time.Duration, stop <-chan struct{}) bool {
+		t.Fatal("backed off")
+		return false
+	}
+
+	// The bad tenant's logs go to the default collectors, without backing off, and
+	// only its own health check fails
+	teamA := MetadataValues{namespace: "ns-a", collector: "team-a"}
+	for _, message := range []string{"one", "two", "three"} {
+		assert.True(t, worker.Deliver(teamA, testEntries(message), nil))
+	}
+	assert.True(t, worker.Deliver(MetadataValues{namespace: "ns-b", collector: "team-b"}, testEntries("four"), nil))
+	assert.Equal(t, []string{"one", "two", "three"}, collector.Lines())
+	assert.Equal(t, []string{"four"}, good.Lines())
+	assert.Equal(t, []string{"output sumo collector ns-a.team-a: credentials rejected, status code: 401"}, health.Problems())
+	assert.Equal(t, int64(1), worker.Metrics.Healthy.Value())
+
+	// Its breaker opened, so it isn't tried again until the cool down is over
+	assert.Equal(t, 2, bad.Requests())
+	health.Recover("output sumo collector ns-a.team-a")
+}
+
+func TestSumoFailover(t *testing.T) {
+	primary := newTestCollector(500)
+	defer primary.Close()
+	secondary := newTestCollector(200)
+	defer secondary.Close()
+	sumo := newTestSumoUploader(primary.URL)
+	sumo.FailoverTrustedTimestampCollectorUrl = secondary.URL
+	sumo.FailoverAfter = time.Minute
+	now := time.Now()
+	failover := sumo.failover("trusted")
+	failover.now = func() time.Time {
+		return now
+	}
+
+	ctx := context.Background()
+	metadata := MetadataValues{trustedTimestamp: true}
+	assert.Error(t, sumo.Send(ctx, metadata, testEntries("one")))
+	now = now.Add(time.Minute)
+	assert.NoError(t, sumo.Send(ctx, metadata, testEntries("two")))
+	assert.Equal(t, []string{"two"}, secondary.Lines())
+	assert.Equal(t, int64(1), sumo.Metrics.Registry.Get("output.sumo.failover.trusted.active").(metrics.Gauge).Value())
+
+	// The untrusted collector has no secondary
+	assert.Error(t, sumo.Send(ctx, MetadataValues{}, testEntries("three")))
+
+	// Fails back once a probe gets through
+	primary.SetStatus(200, "")
+	now = now.Add(DefaultFailoverProbeInterval)
+	assert.NoError(t, sumo.Send(ctx, metadata, testEntries("four")))
+	assert.NoError(t, sumo.Send(ctx, metadata, testEntries("five")))
+	assert.Equal(t, []string{"four", "five"}, primary.Lines())
+	assert.Equal(t, int64(0), sumo.Metrics.Registry.Get("output.sumo.failover.trusted.active").(metrics.Gauge).Value())
+	assert.Equal(t, int64(1), sumo.Metrics.Registry.Get("output.sumo.failover.trusted.duration").(metrics.Timer).Count())
+}
+
+func TestSumoFields(t *testing.T) {
+	var header []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header["X-Sumo-Fields"]
+	}))
+	defer collector.Close()
+	sumo := newTestSumoUploader(collector.URL)
+	metadata := MetadataValues{
+		namespace: "default",
+		pod:       "app-6f9c",
+		owner:     "app",
+		ownerKind: "ReplicaSet",
+		image:     "registry/app:1.0",
+		labels:    map[string]string{"app": "app"},
+	}
+
+	// None unless configured
+	assert.NoError(t, sumo.Send(context.Background(), metadata, testEntries("one")))
+	assert.Nil(t, header)
+
+	sumo.StaticFields = map[string]string{"cluster": "prod-1", "environment": "prod"}
+	sumo.FieldAllowlist = []string{"namespace", "owner", "owner_kind", "image", "unit"}
+	assert.NoError(t, sumo.Send(context.Background(), metadata, testEntries("one")))
+	assert.Equal(t, []string{"cluster=prod-1,environment=prod,image=registry/app:1.0,namespace=default,owner=app,owner_kind=ReplicaSet"}, header)
+
+	// Values can't break up the list
+	metadata.owner = "a,b=c"
+	assert.Equal(t, "cluster=prod-1,environment=prod,image=registry/app:1.0,namespace=default,owner=a_b_c,owner_kind=ReplicaSet", sumo.fields(metadata))
+}
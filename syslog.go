@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Structured data ids have to be qualified with an IANA enterprise number,
+	// 32473 is the one reserved for documentation and examples (RFC 5612)
+	DefaultSyslogSDID = "logfwd@32473"
+
+	syslogDefaultFacility = 1 // user-level
+	syslogDefaultSeverity = 6 // informational
+	syslogNil             = "-"
+
+	// How long to wait to see whether the server has closed the connection
+	syslogConnCheckTimeout = time.Millisecond
+)
+
+// SyslogOutput sends entries as RFC 5424 syslog messages over TCP, optionally TLS,
+// with octet counting framing (RFC 6587). See: https://tools.ietf.org/html/rfc5424
+//
+// Each entry becomes a message with PRI from the journal's PRIORITY and
+// SYSLOG_FACILITY, APP-NAME from SYSLOG_IDENTIFIER, PROCID from _PID, and the
+// category, source and namespace as structured data.
+type SyslogOutput struct {
+	Addr string      // host:port
+	TLS  *tls.Config // nil for plain TCP
+	SDID string      // id of the structured data element the metadata goes in
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Builds a TLS config for a syslog server, trusting the certificates in caFile as
+// well as the system ones if it is set
+func SyslogTLSConfig(caFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (s *SyslogOutput) Name() string {
+	return "syslog"
+}
+
+func (s *SyslogOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	var b bytes.Buffer
+	for _, entry := range batch {
+		msg := s.format(metadata, entry)
+		b.WriteString(strconv.Itoa(len(msg)))
+		b.WriteString(" ")
+		b.WriteString(msg)
+	}
+
+	// One connection, shared by all the workers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !connOpen(s.conn) {
+		// The server hung up, writing would still work until it resets the
+		// connection, and whatever we wrote would be lost
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	done := CloseOnDone(ctx, s.conn)
+	_, err := s.conn.Write(b.Bytes())
+	cancelled := done()
+	if cancelled && err != nil {
+		err = ctx.Err()
+	}
+	if err != nil || cancelled {
+		// Start again with a new connection. Some of the batch may have made it,
+		// in which case it'll be duplicated.
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SyslogOutput) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil || s.TLS == nil {
+		return conn, err
+	}
+
+	config := s.TLS.Clone()
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	done := CloseOnDone(ctx, conn)
+	err = tlsConn.Handshake()
+	if done() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Checks the server hasn't closed conn, by reading from it briefly. Servers don't
+// send anything, so reading times out unless the connection is closed.
+func connOpen(conn net.Conn) bool {
+	err := conn.SetReadDeadline(time.Now().Add(syslogConnCheckTimeout))
+	if err != nil {
+		return false
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		return err == nil
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// Formats an entry as: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func (s *SyslogOutput) format(metadata MetadataValues, entry LogEntry) string {
+	facility := syslogField(entry.Fields, "SYSLOG_FACILITY", syslogDefaultFacility, 23)
+	severity := syslogField(entry.Fields, "PRIORITY", syslogDefaultSeverity, 7)
+
+	sdID := s.SDID
+	if sdID == "" {
+		sdID = DefaultSyslogSDID
+	}
+	var sd strings.Builder
+	sd.WriteString("[" + sdID)
+	for _, param := range []struct{ name, value string }{
+		{"category", metadata.category},
+		{"source", metadata.source},
+		{"namespace", metadata.namespace},
+	} {
+		if param.value != "" {
+			sd.WriteString(" " + param.name + "=\"" + syslogEscapeParam(param.value) + "\"")
+		}
+	}
+	sd.WriteString("]")
+
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s",
+		facility*8+severity,
+		entryTime(entry).Format("2006-01-02T15:04:05.000000Z"),
+		syslogHeaderField(metadata.host, 255),
+		syslogHeaderField(entry.Fields["SYSLOG_IDENTIFIER"], 48),
+		syslogHeaderField(entry.Fields["_PID"], 128),
+		syslogNil, // MSGID
+		sd.String(),
+		entry.Message,
+	)
+}
+
+// Returns a numeric journal field if it is set and in range, otherwise def
+func syslogField(fields map[string]string, name string, def int, max int) int {
+	n, err := strconv.Atoi(fields[name])
+	if err != nil || n < 0 || n > max {
+		return def
+	}
+	return n
+}
+
+// Header fields are printable US-ASCII without spaces, of limited length, or - if empty
+func syslogHeaderField(value string, maxLen int) string {
+	var b strings.Builder
+	for i := 0; i < len(value) && b.Len() < maxLen; i++ {
+		if value[i] > 32 && value[i] < 127 {
+			b.WriteByte(value[i])
+		}
+	}
+	if b.Len() == 0 {
+		return syslogNil
+	}
+	return b.String()
+}
+
+// In structured data param values ", \ and ] have to be escaped
+func syslogEscapeParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSyslogServer accepts connections and reads octet counted messages off them
+type testSyslogServer struct {
+	net.Listener
+	mu       sync.Mutex
+	messages []string
+	hangUp   bool // after the first message on the next connection
+	hungUp   int
+}
+
+func newTestSyslogServer(t *testing.T, config *tls.Config) *testSyslogServer {
+	return newTestSyslogServerOn(t, "127.0.0.1:0", config)
+}
+
+func newTestSyslogServerOn(t *testing.T, addr string, config *tls.Config) *testSyslogServer {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	s := &testSyslogServer{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.read(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSyslogServer) read(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	hangUp := s.hangUp
+	s.hangUp = false
+	s.mu.Unlock()
+	r := bufio.NewReader(conn)
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.messages = append(s.messages, string(msg))
+		s.mu.Unlock()
+		if hangUp {
+			conn.Close()
+			s.mu.Lock()
+			s.hungUp++
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *testSyslogServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages
+}
+
+var syslogTestMetadata = MetadataValues{
+	category:  `prod/kubernetes/kube-system/kube-proxy`,
+	source:    `kube-system.kube-proxy-abcde`,
+	host:      "node-1",
+	namespace: "kube-system",
+}
+
+var syslogTestEntries = []LogEntry{
+	{
+		Timestamp: 1563537600123456,
+		Message:   "hello",
+		Fields:    map[string]string{"PRIORITY": "3", "SYSLOG_FACILITY": "4", "SYSLOG_IDENTIFIER": "sshd", "_PID": "1234"},
+	},
+	{
+		// multi line, with nothing from the journal but the message
+		Timestamp: 1563537601000000,
+		Message:   "line one\nline two",
+	},
+}
+
+func TestSyslogOutput(t *testing.T) {
+	server := newTestSyslogServer(t, nil)
+	defer server.Close()
+	output := &SyslogOutput{Addr: server.Addr().String()}
+
+	assert.NoError(t, output.Send(context.Background(), syslogTestMetadata, syslogTestEntries))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 2
+	})
+	assert.Equal(t, []string{
+		`<35>1 2019-07-19T12:00:00.123456Z node-1 sshd 1234 - [logfwd@32473 category="prod/kubernetes/kube-system/kube-proxy" source="kube-system.kube-proxy-abcde" namespace="kube-system"] hello`,
+		`<14>1 2019-07-19T12:00:01.000000Z node-1 - - - [logfwd@32473 category="prod/kubernetes/kube-system/kube-proxy" source="kube-system.kube-proxy-abcde" namespace="kube-system"] line one` + "\n" + `line two`,
+	}, server.Messages())
+}
+
+func TestSyslogReconnects(t *testing.T) {
+	server := newTestSyslogServer(t, nil)
+	output := &SyslogOutput{Addr: server.Addr().String()}
+	assert.NoError(t, output.Send(context.Background(), MetadataValues{}, testEntries("one")))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 1
+	})
+
+	// Connection goes away, the send fails, then the next one reconnects
+	server.Close()
+	output.conn.Close()
+	assert.Error(t, output.Send(context.Background(), MetadataValues{}, testEntries("two")))
+	assert.Nil(t, output.conn)
+
+	server = newTestSyslogServerOn(t, output.Addr, nil)
+	defer server.Close()
+	assert.NoError(t, output.Send(context.Background(), MetadataValues{}, testEntries("three")))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 1
+	})
+	assert.True(t, strings.HasSuffix(server.Messages()[0], " three"))
+}
+
+func TestSyslogServerHangsUp(t *testing.T) {
+	server := newTestSyslogServer(t, nil)
+	defer server.Close()
+	server.mu.Lock()
+	server.hangUp = true
+	server.mu.Unlock()
+	output := &SyslogOutput{Addr: server.Addr().String()}
+	assert.NoError(t, output.Send(context.Background(), MetadataValues{}, testEntries("one")))
+	waitFor(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.hungUp == 1
+	})
+
+	// Writing to the connection would still work, but nothing would read it
+	assert.NoError(t, output.Send(context.Background(), MetadataValues{}, testEntries("two")))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 2
+	})
+	assert.True(t, strings.HasSuffix(server.Messages()[1], " two"))
+
+	// A connection that's still open is kept
+	conn := output.conn
+	assert.NoError(t, output.Send(context.Background(), MetadataValues{}, testEntries("three")))
+	assert.Equal(t, conn, output.conn)
+}
+
+func TestSyslogTLS(t *testing.T) {
+	// Borrow httptest's certificate, it's good for 127.0.0.1
+	https := httptest.NewTLSServer(nil)
+	cert := https.TLS.Certificates[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(https.Certificate())
+	https.Close()
+
+	server := newTestSyslogServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer server.Close()
+
+	// Not trusted
+	output := &SyslogOutput{Addr: server.Addr().String(), TLS: &tls.Config{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Error(t, output.Send(ctx, MetadataValues{}, testEntries("one")))
+
+	output = &SyslogOutput{Addr: server.Addr().String(), TLS: &tls.Config{RootCAs: pool}}
+	assert.NoError(t, output.Send(ctx, MetadataValues{}, testEntries("two")))
+	waitFor(t, func() bool {
+		return len(server.Messages()) == 1
+	})
+	assert.True(t, strings.HasSuffix(server.Messages()[0], " two"))
+}
+
+func TestSyslogHeaderField(t *testing.T) {
+	assert.Equal(t, "-", syslogHeaderField("", 48))
+	assert.Equal(t, "myapp", syslogHeaderField("my app", 48))
+	assert.Equal(t, "abc", syslogHeaderField("abcdef", 3))
+	assert.Equal(t, `a\"b\\c\]`, syslogEscapeParam(`a"b\c]`))
+}
+
+func TestSyslogCancelled(t *testing.T) {
+	l := newStuckPeer(t)
+	defer l.Close()
+	assertSendCancels(t, &SyslogOutput{Addr: l.Addr().String()})
+
+	// Including while waiting on the TLS handshake
+	assertSendCancels(t, &SyslogOutput{Addr: l.Addr().String(), TLS: &tls.Config{}})
+}
@@ -1,6 +1,14 @@
 package main
 
-import "strings"
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // All this stuff is O(n) or O(n^2) and we don't care.
 
@@ -53,3 +61,85 @@ func Split(s string, sep string) []string {
 	}
 	return strings.Split(s, sep)
 }
+
+// Returns the value of an env variable, or def if it isn't set
+func GetEnv(envVariable string, def string) string {
+	value := os.Getenv(envVariable)
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// Returns the integer in an env variable, or def if it isn't set. Fails if it isn't a number.
+func GetEnvInt(envVariable string, def int) int {
+	value := os.Getenv(envVariable)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be a number: %s", envVariable, err)
+	}
+	return n
+}
+
+// Returns the duration (e.g 30s) in an env variable, or def if it isn't set
+func GetEnvDuration(envVariable string, def time.Duration) time.Duration {
+	value := os.Getenv(envVariable)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be a duration: %s", envVariable, err)
+	}
+	return d
+}
+
+// Returns the env variables named <prefix><NAME> by lowercased NAME, e.g SUMO_COLLECTOR_URL_SOC
+// is soc for the prefix SUMO_COLLECTOR_URL_. Empty values are left out.
+func GetEnvByPrefix(prefix string) map[string]string {
+	values := map[string]string{}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], prefix) && len(parts[0]) > len(prefix) && parts[1] != "" {
+			values[strings.ToLower(strings.TrimPrefix(parts[0], prefix))] = parts[1]
+		}
+	}
+	return values
+}
+
+// Parses HTTP headers from a comma separated list of name=value pairs
+func ParseHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" {
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return headers
+}
+
+// Closes conn if ctx is done before the returned func is called, to unblock a read
+// or write that a deadline alone wouldn't, as ctx can be cancelled without one. The
+// returned func must be called once done with conn for ctx, and returns true if
+// conn was closed, in which case it can't be used again.
+func CloseOnDone(ctx context.Context, conn io.Closer) func() bool {
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-closed
+	}
+}
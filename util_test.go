@@ -1,10 +1,26 @@
 package main
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
+// Polls cond until it is true, failing the test if that takes more than a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestListContains(t *testing.T) {
 	a := []string{"foo", "bar"}
 	assert.True(t, ListContains(a, "foo"))
@@ -25,3 +41,77 @@ func TestListSubtract(t *testing.T) {
 	assert.Equal(t, []string{"foo", "baz"}, ListSubtract(a, b))
 	assert.Equal(t, []string{}, ListSubtract(b, a))
 }
+
+func TestParseHeaders(t *testing.T) {
+	assert.Equal(t, map[string]string{}, ParseHeaders(""))
+	assert.Equal(t, map[string]string{"Authorization": "Basic abc==", "X-Tenant": "a"},
+		ParseHeaders("Authorization=Basic abc==, X-Tenant=a,junk"))
+}
+
+func TestGetEnvByPrefix(t *testing.T) {
+	os.Setenv("TEST_COLLECTOR_URL_SOC", "http://soc")
+	os.Setenv("TEST_COLLECTOR_URL_EMPTY", "")
+	os.Setenv("TEST_COLLECTOR_URL_", "http://nameless")
+	defer os.Unsetenv("TEST_COLLECTOR_URL_SOC")
+	defer os.Unsetenv("TEST_COLLECTOR_URL_EMPTY")
+	defer os.Unsetenv("TEST_COLLECTOR_URL_")
+	assert.Equal(t, map[string]string{"soc": "http://soc"}, GetEnvByPrefix("TEST_COLLECTOR_URL_"))
+}
+
+// Listens for connections that are accepted but never read from, so writes to them
+// block once the socket buffers are full
+func newStuckPeer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return l
+}
+
+// Sends a batch too big to write to a stuck peer, with a ctx that has no deadline,
+// and checks that Send gives up once the ctx is cancelled
+func assertSendCancels(t *testing.T, output Output) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- output.Send(ctx, MetadataValues{category: "c"}, testEntries(strings.Repeat("x", 16*1024*1024)))
+	}()
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send didn't give up once cancelled")
+	}
+}
+
+func TestCloseOnDone(t *testing.T) {
+	l := newStuckPeer(t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	done := CloseOnDone(context.Background(), conn)
+	assert.False(t, done())
+	_, err = conn.Write([]byte("still open"))
+	assert.NoError(t, err)
+
+	// Unblocks a read that would otherwise wait forever
+	ctx, cancel := context.WithCancel(context.Background())
+	done = CloseOnDone(ctx, conn)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.True(t, done())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+)
+
+const (
+	WebhookFormatJSON   = "json"   // a JSON array of records
+	WebhookFormatNDJSON = "ndjson" // one record per line
+)
+
+// WebhookOutput POSTs batches to any URL, as a JSON array or as newline delimited
+// JSON. Each record is a jsonRecord, or whatever Template renders it as, which has
+// to be valid JSON.
+type WebhookOutput struct {
+	httpClient  *http.Client
+	URL         string
+	Format      string            // WebhookFormatJSON or WebhookFormatNDJSON
+	Headers     map[string]string // sent with every request
+	Username    string            // for basic auth
+	Password    string
+	BearerToken string
+	Compress    bool
+	Template    *template.Template // renders a jsonRecord, if nil it is sent as is
+}
+
+// Parses a template for webhook records. Values can be written as JSON with json,
+// e.g. {"msg": {{json .Message}}, "unit": {{json (index .Fields "_SYSTEMD_UNIT")}}}
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+func (webhook *WebhookOutput) Name() string {
+	return "webhook"
+}
+
+func (webhook *WebhookOutput) Send(ctx context.Context, metadata MetadataValues, batch []LogEntry) error {
+	var records [][]byte
+	var invalid []LogEntry
+	var firstError error
+	for _, entry := range batch {
+		record, err := webhook.record(metadata, entry)
+		if err != nil {
+			// It'll never render, so don't hold the rest up
+			invalid = append(invalid, entry)
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if len(records) > 0 {
+		err := webhook.post(ctx, records)
+		if err != nil {
+			return err
+		}
+	}
+	if len(invalid) > 0 {
+		return &PartialError{
+			Rejected: invalid,
+			Err:      fmt.Errorf("%d of %d records didn't render as JSON, first error: %s", len(invalid), len(batch), firstError),
+		}
+	}
+	return nil
+}
+
+func (webhook *WebhookOutput) record(metadata MetadataValues, entry LogEntry) ([]byte, error) {
+	record := newJSONRecord(metadata, entry)
+	if webhook.Template == nil {
+		return json.Marshal(record)
+	}
+
+	var b bytes.Buffer
+	err := webhook.Template.Execute(&b, record)
+	if err != nil {
+		return nil, err
+	}
+	// Compact it, so it is on one line for ndjson
+	var compacted bytes.Buffer
+	err = json.Compact(&compacted, b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("template output isn't valid JSON: %s", err)
+	}
+	return compacted.Bytes(), nil
+}
+
+func (webhook *WebhookOutput) post(ctx context.Context, records [][]byte) error {
+	var body bytes.Buffer
+	contentType := "application/json"
+	if webhook.Format == WebhookFormatNDJSON {
+		contentType = "application/x-ndjson"
+		for _, record := range records {
+			body.Write(record)
+			body.WriteByte('\n')
+		}
+	} else {
+		body.WriteByte('[')
+		for i, record := range records {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(record)
+		}
+		body.WriteByte(']')
+	}
+
+	payload := body.Bytes()
+	if webhook.Compress {
+		payload = compress(body.String())
+	}
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if webhook.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if webhook.Username != "" {
+		req.SetBasicAuth(webhook.Username, webhook.Password)
+	} else if webhook.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+webhook.BearerToken)
+	}
+
+	resp, err := webhook.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading webhook response: %s", err)
+	}
+	return HTTPResponseError(resp, respBody)
+}
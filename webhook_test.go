@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testWebhook records the requests it gets, gunzipping the body if need be
+type testWebhook struct {
+	*httptest.Server
+	bodies  []string
+	headers []http.Header
+}
+
+func newTestWebhook(status int) *testWebhook {
+	w := &testWebhook{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				rw.WriteHeader(400)
+				return
+			}
+			body = gz
+		}
+		b, _ := ioutil.ReadAll(body)
+		w.bodies = append(w.bodies, string(b))
+		w.headers = append(w.headers, r.Header)
+		rw.WriteHeader(status)
+	}))
+	return w
+}
+
+func webhookTestEntries() []LogEntry {
+	entries := testEntries("one", "two")
+	entries[0].Cursor = "c1"
+	entries[0].Timestamp = 1563537600123456
+	entries[0].Fields = map[string]string{"_SYSTEMD_UNIT": "kubelet.service"}
+	entries[1].Cursor = "c2"
+	entries[1].Timestamp = 1563537601000000
+	return entries
+}
+
+func TestWebhookJSON(t *testing.T) {
+	server := newTestWebhook(200)
+	defer server.Close()
+	webhook := &WebhookOutput{
+		httpClient:  &http.Client{},
+		URL:         server.URL + "/ingest",
+		Headers:     map[string]string{"X-Team": "platform"},
+		BearerToken: "token",
+	}
+
+	metadata := MetadataValues{category: "prod/systemd/kubelet", source: "kubelet", host: "node-1"}
+	assert.NoError(t, webhook.Send(context.Background(), metadata, webhookTestEntries()))
+	assert.Equal(t, []string{`[` +
+		`{"timestamp":"2019-07-19T12:00:00.123456Z","message":"one","cursor":"c1","category":"prod/systemd/kubelet","source":"kubelet","host":"node-1","fields":{"_SYSTEMD_UNIT":"kubelet.service"}},` +
+		`{"timestamp":"2019-07-19T12:00:01Z","message":"two","cursor":"c2","category":"prod/systemd/kubelet","source":"kubelet","host":"node-1","fields":null}` +
+		`]`}, server.bodies)
+	assert.Equal(t, "application/json", server.headers[0].Get("Content-Type"))
+	assert.Equal(t, "Bearer token", server.headers[0].Get("Authorization"))
+	assert.Equal(t, "platform", server.headers[0].Get("X-Team"))
+}
+
+func TestWebhookNDJSONTemplate(t *testing.T) {
+	server := newTestWebhook(200)
+	defer server.Close()
+	tmpl, err := ParseWebhookTemplate(`{
+		"msg": {{json .Message}},
+		"unit": {{json (index .Fields "_SYSTEMD_UNIT")}},
+		"ts": {{.Timestamp.Unix}}
+	}`)
+	assert.NoError(t, err)
+	webhook := &WebhookOutput{
+		httpClient: &http.Client{},
+		URL:        server.URL,
+		Format:     WebhookFormatNDJSON,
+		Username:   "user",
+		Password:   "pass",
+		Compress:   true,
+		Template:   tmpl,
+	}
+
+	assert.NoError(t, webhook.Send(context.Background(), MetadataValues{}, webhookTestEntries()))
+	assert.Equal(t, []string{
+		`{"msg":"one","unit":"kubelet.service","ts":1563537600}` + "\n" +
+			`{"msg":"two","unit":"","ts":1563537601}` + "\n",
+	}, server.bodies)
+	assert.Equal(t, "application/x-ndjson", server.headers[0].Get("Content-Type"))
+	username, password, ok := (&http.Request{Header: server.headers[0]}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+}
+
+func TestWebhookInvalidTemplateOutput(t *testing.T) {
+	server := newTestWebhook(200)
+	defer server.Close()
+	tmpl, err := ParseWebhookTemplate(`{"msg": {{.Message}}}`)
+	assert.NoError(t, err)
+	webhook := &WebhookOutput{httpClient: &http.Client{}, URL: server.URL, Template: tmpl}
+
+	// "1" renders as a number, "one" isn't JSON
+	batch := testEntries("one", "1")
+	err = webhook.Send(context.Background(), MetadataValues{}, batch)
+	if assert.IsType(t, &PartialError{}, err) {
+		assert.Equal(t, batch[:1], err.(*PartialError).Rejected)
+		assert.Empty(t, err.(*PartialError).Retry)
+	}
+	assert.Equal(t, []string{`[{"msg":1}]`}, server.bodies)
+}
+
+func TestWebhookFailure(t *testing.T) {
+	server := newTestWebhook(500)
+	defer server.Close()
+	webhook := &WebhookOutput{httpClient: &http.Client{}, URL: server.URL}
+
+	err := webhook.Send(context.Background(), MetadataValues{}, testEntries("one"))
+	assert.Error(t, err)
+	assert.True(t, EndpointFailed(err))
+}